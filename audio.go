@@ -0,0 +1,75 @@
+package media_shrinker
+
+import "fmt"
+
+// Voice recordings (voice memos, messenger voice notes, recorder apps) are re-encoded with
+// settings meant for speech: a low bitrate, and optionally a single channel, since voice is hardly
+// ever stereo; music and field recordings keep their channels unless asked otherwise.
+
+const (
+	OpusCodec = "opus"
+	AACCodec  = "aac"
+)
+
+// audioCodec is the codec audio files are actually encoded with.
+// Opus is much better for speech, but needs an ffmpeg built with libopus.
+func audioCodec(opts *Options) string {
+	if opts.AudioCodec == OpusCodec && toolchain.FFmpeg.Available() && !toolchain.FFmpeg.HasLibrary("libopus") {
+		return AACCodec
+	}
+	return opts.AudioCodec
+}
+
+func audioExt(codec string) string {
+	if codec == OpusCodec {
+		return ".opus"
+	}
+	return ".m4a"
+}
+
+// returns nil if success
+func ShrinkAudio(request ProcessingRequest, ui UI) error {
+	info, err := ProbeAudioInfo(request.InputPath)
+	if err != nil {
+		return fmt.Errorf("Probing audio failed: %w", err)
+	}
+
+	opts := request.Options
+	codec := audioCodec(opts)
+
+	// cover art and such are dropped; the tags are kept
+	var args = []string{
+		"-y", "-i", request.InputPath,
+		"-map", "0:a:0", "-map_metadata", "0",
+	}
+	if opts.AudioMono && info.Channels > 1 {
+		args = append(args, "-ac", "1")
+	}
+	bitrate := fmt.Sprintf("%dk", opts.AudioBitrate)
+	switch codec {
+	case OpusCodec:
+		args = append(args, "-c:a", "libopus", "-b:a", bitrate, "-vbr", "on", "-application", "voip")
+	default:
+		args = append(args, "-c:a", "aac", "-b:a", bitrate)
+	}
+	args = append(args, request.OutputPath)
+
+	err = runFFmpeg(args, request.Log, ui, func(durationProcessed float64) {
+		request.Target.Percentage = (durationProcessed / info.Duration) * 100
+		request.Target.Processed = durationProcessed
+		ui.Update()
+	})
+	if err != nil {
+		return err
+	}
+
+	// check the duration of the written file matches our duration
+	outInfo, err := ProbeAudioInfo(request.OutputPath)
+	if err != nil {
+		return fmt.Errorf("Conversion appears to be failed because ffprobe failed: %w", err)
+	}
+	if !DurationsRoughlyEqual(info.Duration, outInfo.Duration) {
+		return fmt.Errorf("Conversion failed; duration mismatch: %8.2f -> %8.2f", info.Duration, outInfo.Duration)
+	}
+	return nil
+}
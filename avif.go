@@ -0,0 +1,169 @@
+package media_shrinker
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+)
+
+// AVIF output for images, for archival copies. Encoded by avifenc if it's there, which also embeds
+// the EXIF, XMP and ICC profile, or else by ffmpeg's AV1 encoders, which can't embed any of them.
+//
+// ffmpeg's encoders drop the alpha channel, so transparent images stay png without avifenc.
+//
+// The result is decoded back with ffmpeg (or avifdec) to make sure it's a complete image of the
+// right size; when neither can decode it, it's recorded as unverified.
+
+const AVIFFormat = "avif"
+
+// ffmpegAVIFEncoder is the AV1 encoder of ffmpeg used for still images, or empty if there's none.
+// ffmpeg can only write avif files since 5.1.
+func ffmpegAVIFEncoder() string {
+	if !toolchain.FFmpeg.Available() || !toolchain.FFmpeg.AtLeast(5, 1) {
+		return ""
+	}
+	switch {
+	case toolchain.FFmpeg.HasLibrary("libaom"):
+		return "libaom-av1"
+	case toolchain.FFmpeg.HasLibrary("libsvtav1"):
+		return "libsvtav1"
+	}
+	return ""
+}
+
+func avifEncoderAvailable() bool {
+	return toolchain.AVIFEnc.Available() || ffmpegAVIFEncoder() != ""
+}
+
+// avifKeepsImage tells whether the image can be encoded as avif without losing its transparency
+func avifKeepsImage(img image.Image) bool {
+	return toolchain.AVIFEnc.Available() || !hasAlpha(img)
+}
+
+// encodeAVIF writes the image to request.OutputPath as avif, with the given metadata and colour profile if possible
+func encodeAVIF(request ProcessingRequest, img image.Image, policy *ImagePolicy, metadata []jpegSegment, colorProfile []byte, ui UI) (imageEncoding, error) {
+	var encoding imageEncoding
+	sourcePath, err := writeEncoderSource(request, img)
+	if err != nil {
+		return encoding, err
+	}
+	defer os.Remove(sourcePath)
+
+	if toolchain.AVIFEnc.Available() {
+		encoding.Encoder = "avifenc"
+		args := []string{"--jobs", "all", "--speed", fmt.Sprint(policy.Speed)}
+		if toolchain.AVIFEnc.AtLeast(1, 0) {
+			args = append(args, "-q", fmt.Sprint(policy.Quality))
+		} else {
+			// older versions only take the range of quantizers
+			quantizer := fmt.Sprint(avifQuantizer(policy.Quality))
+			args = append(args, "--min", quantizer, "--max", quantizer)
+		}
+
+		// avifenc takes the metadata from files
+		var files []string
+		defer func() {
+			for _, file := range files {
+				os.Remove(file)
+			}
+		}()
+		addMetadata := func(flag string, ext string, data []byte) error {
+			if data == nil {
+				return nil
+			}
+			file := request.OutputPath + ext
+			files = append(files, file)
+			if err := ioutil.WriteFile(file, data, 0o644); err != nil {
+				return fmt.Errorf("Could not write temporary file %s: %w", file, err)
+			}
+			args = append(args, flag, file)
+			return nil
+		}
+		for _, segment := range metadata {
+			switch {
+			case bytes.HasPrefix(segment.Data, exifHeader):
+				err = addMetadata("--exif", ".exif", segment.Data[len(exifHeader):])
+			case bytes.HasPrefix(segment.Data, xmpHeader):
+				err = addMetadata("--xmp", ".xmp", segment.Data[len(xmpHeader):])
+			}
+			if err != nil {
+				return encoding, err
+			}
+		}
+		if err := addMetadata("--icc", ".icc", colorProfile); err != nil {
+			return encoding, err
+		}
+
+		args = append(args, sourcePath, request.OutputPath)
+		_, err = commandOutput(avifencCommand(args...), request.Log, ui)
+	} else {
+		encoder := ffmpegAVIFEncoder()
+		encoding.Encoder = "ffmpeg " + encoder
+		args := []string{"-y", "-i", sourcePath, "-c:v", encoder, "-crf", fmt.Sprint(avifQuantizer(policy.Quality))}
+		if encoder == "libaom-av1" {
+			args = append(args, "-still-picture", "1", "-cpu-used", fmt.Sprint(minInt(policy.Speed, 8)))
+		} else {
+			args = append(args, "-preset", fmt.Sprint(policy.Speed))
+		}
+		args = append(args, "-frames:v", "1", "-f", "avif", request.OutputPath)
+		_, err = ffmpegOutput(args, request.Log, ui)
+		if err == nil && (len(metadata) > 0 || colorProfile != nil) {
+			ui.Logf("warning: ffmpeg can't embed metadata or colour profiles in avif; %s loses them (install avifenc to keep them)", request.Target.Name)
+		}
+	}
+	if err != nil {
+		return encoding, fmt.Errorf("Could not encode avif: %w", err)
+	}
+
+	verified, err := verifyAVIF(request, img.Bounds().Size(), ui)
+	encoding.Unverified = !verified
+	return encoding, err
+}
+
+// avifQuantizer maps the 1-100 quality to the 0-63 quantizer (and crf) of AV1, where lower is better
+func avifQuantizer(quality int) int {
+	return (100 - quality) * 63 / 100
+}
+
+// verifyAVIF decodes the whole image and checks it has the expected size. ffmpeg can only read
+// avif files since 6.0, so older versions leave it to avifdec; it returns false if neither is there.
+func verifyAVIF(request ProcessingRequest, size image.Point, ui UI) (bool, error) {
+	if toolchain.FFmpeg.Available() && toolchain.FFmpeg.AtLeast(6, 0) {
+		cmd := ffmpegCommand("-v", "error", "-i", request.OutputPath, "-frames:v", "1", "-f", "rawvideo", "-pix_fmt", "gray", "-")
+		var pixels bytes.Buffer
+		if err := pipeCommand(cmd, nil, &pixels, request.Log, ui); err != nil {
+			return true, fmt.Errorf("Could not decode the avif back: %w", err)
+		}
+		if pixels.Len() != size.X*size.Y {
+			return true, fmt.Errorf("avif decoded to %d pixels instead of %dx%d", pixels.Len(), size.X, size.Y)
+		}
+		return true, nil
+	}
+
+	if toolchain.AVIFDec.Available() {
+		decodedPath := request.OutputPath + ".decoded.png"
+		defer os.Remove(decodedPath)
+		if _, err := commandOutput(avifdecCommand(request.OutputPath, decodedPath), request.Log, ui); err != nil {
+			return true, fmt.Errorf("Could not decode the avif back: %w", err)
+		}
+		decoded, err := os.Open(decodedPath)
+		if err != nil {
+			return true, fmt.Errorf("Could not decode the avif back: %w", err)
+		}
+		defer decoded.Close()
+		img, err := png.Decode(decoded)
+		if err != nil {
+			return true, fmt.Errorf("Could not read the decoded avif: %w", err)
+		}
+		if decodedSize := img.Bounds().Size(); decodedSize != size {
+			return true, fmt.Errorf("avif decoded to %dx%d instead of %dx%d", decodedSize.X, decodedSize.Y, size.X, size.Y)
+		}
+		return true, nil
+	}
+
+	ui.Logf("warning: could not verify %s; decoding avif needs ffmpeg 6.0 or newer, or avifdec", request.OutputPath)
+	return false, nil
+}
@@ -0,0 +1,297 @@
+package media_shrinker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Long videos are split at keyframes (by stream copying, so nothing is lost) into segments.
+// The segments are encoded by several ffmpeg processes at the same time, and then
+// concatenated back together, again by stream copying.
+//
+// Audio is not split; it's taken from the original file when the segments are joined,
+// otherwise we'd get small gaps at the segment boundaries.
+//
+// The chunks directory doubles as a checkpoint: a journal records which chunks are already
+// encoded, so if we get interrupted, the next run only encodes the remaining chunks.
+
+func useChunks(opts *Options, size VideoSize) bool {
+	if opts == nil || opts.ChunkJobs <= 1 || opts.ChunkDuration <= 0 {
+		return false
+	}
+	return size.Duration >= opts.ChunkMinDuration.Seconds()
+}
+
+type videoChunk struct {
+	SrcPath, EncPath string
+	Duration         float64 // in seconds
+	Done             bool    // encoded successfully
+}
+
+// chunkJournal is saved next to the chunks and describes what they were made from
+type chunkJournal struct {
+	InputPath     string
+	InputSize     int64
+	InputModTime  time.Time
+	EncodeArgs    []string
+	ChunkDuration float64
+	Chunks        []videoChunk
+}
+
+const journalName = "journal.json"
+
+func shrinkMovieChunked(request ProcessingRequest, size VideoSize, encodeArgs []string, ui UI) (result error) {
+	opts := request.Options
+	chunksDir := request.OutputPath + ".chunks"
+
+	inputInfo, err := os.Stat(request.InputPath)
+	if err != nil {
+		return fmt.Errorf("Can't find input file: %w", err)
+	}
+	journal := chunkJournal{
+		InputPath:     request.InputPath,
+		InputSize:     inputInfo.Size(),
+		InputModTime:  inputInfo.ModTime(),
+		EncodeArgs:    encodeArgs,
+		ChunkDuration: opts.ChunkDuration.Seconds(),
+	}
+
+	resumed := false
+	if opts.Resume {
+		resumed = loadChunkJournal(chunksDir, &journal)
+	}
+
+	defer func() {
+		// keep the chunks around for the next run unless we're done with them
+		if result == nil || !opts.Resume {
+			os.RemoveAll(chunksDir)
+		}
+	}()
+
+	if resumed {
+		doneCount := 0
+		for _, chunk := range journal.Chunks {
+			if chunk.Done {
+				doneCount++
+			}
+		}
+		ui.Logf("Resuming %s: %d of %d chunks already encoded", request.Target.Name, doneCount, len(journal.Chunks))
+	} else {
+		os.RemoveAll(chunksDir)
+		if err := os.MkdirAll(chunksDir, 0o755); err != nil {
+			return fmt.Errorf("Could not create directory for video chunks: %w", err)
+		}
+
+		journal.Chunks, err = splitVideo(request.InputPath, chunksDir, journal.ChunkDuration, request.Log, ui)
+		if err != nil {
+			return err
+		}
+		ui.Logf("Split %s into %d chunks", request.Target.Name, len(journal.Chunks))
+
+		if opts.Resume {
+			if err := saveChunkJournal(chunksDir, &journal); err != nil {
+				ui.Logf("Could not save chunks journal; %s will not be resumable: %v", request.Target.Name, err)
+			}
+		}
+	}
+
+	err = encodeChunks(request, &journal, chunksDir, size.Duration, opts.ChunkJobs, ui)
+	if err != nil {
+		return err
+	}
+
+	return joinChunks(request, journal.Chunks, chunksDir, ui)
+}
+
+// loadChunkJournal loads the journal of a previous run into journal, but only if it was made
+// from the same input file with the same settings, and all the chunks it lists are still there.
+func loadChunkJournal(dir string, journal *chunkJournal) bool {
+	data, err := ioutil.ReadFile(path.Join(dir, journalName))
+	if err != nil {
+		return false
+	}
+	var saved chunkJournal
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return false
+	}
+	if saved.InputPath != journal.InputPath || saved.InputSize != journal.InputSize ||
+		!saved.InputModTime.Equal(journal.InputModTime) || saved.ChunkDuration != journal.ChunkDuration ||
+		strings.Join(saved.EncodeArgs, " ") != strings.Join(journal.EncodeArgs, " ") || len(saved.Chunks) == 0 {
+		return false
+	}
+	for _, chunk := range saved.Chunks {
+		if _, err := os.Stat(chunk.SrcPath); err != nil {
+			return false
+		}
+		if chunk.Done {
+			if _, err := os.Stat(chunk.EncPath); err != nil {
+				return false
+			}
+		}
+	}
+	journal.Chunks = saved.Chunks
+	return true
+}
+
+// saveChunkJournal writes the journal to a temporary file first so an interruption
+// can never leave a half written journal behind
+func saveChunkJournal(dir string, journal *chunkJournal) error {
+	data, err := json.MarshalIndent(journal, "", "\t")
+	if err != nil {
+		return err
+	}
+	journalPath := path.Join(dir, journalName)
+	if err := ioutil.WriteFile(journalPath+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(journalPath+".tmp", journalPath)
+}
+
+// splitVideo copies the video stream of inpath into segments of about segmentDuration seconds each.
+// The segment muxer can only cut at keyframes, so segments can be somewhat longer than requested.
+func splitVideo(inpath string, dir string, segmentDuration float64, log *FileLog, ui UI) ([]videoChunk, error) {
+	var args = []string{
+		"-y", "-i", inpath,
+		"-map", "0:v:0", "-c", "copy",
+		"-f", "segment", "-segment_time", fmt.Sprintf("%.3f", segmentDuration), "-reset_timestamps", "1",
+		path.Join(dir, "src%04d.mp4"),
+	}
+	if err := runFFmpeg(args, log, ui, nil); err != nil {
+		return nil, fmt.Errorf("Splitting video into chunks failed: %w", err)
+	}
+
+	names, err := filepath.Glob(path.Join(dir, "src*.mp4"))
+	if err != nil || len(names) == 0 {
+		return nil, fmt.Errorf("Splitting video into chunks produced no files")
+	}
+	sort.Strings(names)
+
+	chunks := make([]videoChunk, len(names))
+	for index, name := range names {
+		chunkSize, err := ProbeVideoSize(name)
+		if err != nil {
+			return nil, fmt.Errorf("Probing video chunk failed: %w", err)
+		}
+		chunks[index] = videoChunk{
+			SrcPath:  name,
+			EncPath:  path.Join(dir, strings.Replace(path.Base(name), "src", "enc", 1)),
+			Duration: chunkSize.Duration,
+		}
+	}
+	return chunks, nil
+}
+
+// encodeChunks encodes the chunks of the journal that are not done yet using `jobs` concurrent ffmpeg processes.
+// The progress of all chunks is summed up and reported on the target media file.
+func encodeChunks(request ProcessingRequest, journal *chunkJournal, dir string, totalDuration float64, jobs int, ui UI) error {
+	if jobs < 1 {
+		jobs = 1
+	}
+	chunks := journal.Chunks
+	var mutex sync.Mutex
+	processed := make([]float64, len(chunks))
+	for index, chunk := range chunks {
+		if chunk.Done {
+			processed[index] = chunk.Duration
+		}
+	}
+	var firstError error
+
+	updateProgress := func(index int, durationProcessed float64) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		processed[index] = durationProcessed
+		var total float64
+		for _, p := range processed {
+			total += p
+		}
+		request.Target.Processed = total
+		request.Target.Percentage = (total / totalDuration) * 100
+		ui.Update()
+	}
+
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for worker := 0; worker < jobs; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range queue {
+				mutex.Lock()
+				failed := firstError != nil
+				mutex.Unlock()
+				if failed {
+					continue
+				}
+
+				chunk := chunks[index]
+				args := []string{"-y", "-i", chunk.SrcPath, "-an"}
+				args = append(args, journal.EncodeArgs...)
+				args = append(args, chunk.EncPath)
+				err := runFFmpeg(args, request.Log, ui, func(durationProcessed float64) {
+					updateProgress(index, durationProcessed)
+				})
+				if err != nil {
+					mutex.Lock()
+					if firstError == nil {
+						firstError = fmt.Errorf("Encoding chunk %d of %d failed: %w", index+1, len(chunks), err)
+					}
+					mutex.Unlock()
+					continue
+				}
+				updateProgress(index, chunk.Duration)
+
+				if request.Options.Resume {
+					mutex.Lock()
+					chunks[index].Done = true
+					err = saveChunkJournal(dir, journal)
+					mutex.Unlock()
+					if err != nil {
+						ui.Logf("Could not update chunks journal: %v", err)
+					}
+				}
+			}
+		}()
+	}
+	for index, chunk := range chunks {
+		if !chunk.Done {
+			queue <- index
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	return firstError
+}
+
+// joinChunks concatenates the encoded chunks and adds the audio (and metadata) of the original file
+func joinChunks(request ProcessingRequest, chunks []videoChunk, dir string, ui UI) error {
+	var list strings.Builder
+	for _, chunk := range chunks {
+		fmt.Fprintf(&list, "file '%s'\n", path.Base(chunk.EncPath))
+	}
+	listPath := path.Join(dir, "chunks.txt")
+	if err := ioutil.WriteFile(listPath, []byte(list.String()), 0o644); err != nil {
+		return fmt.Errorf("Could not write list of video chunks: %w", err)
+	}
+
+	var args = []string{
+		"-y", "-f", "concat", "-safe", "0", "-i", listPath,
+		"-i", request.InputPath,
+		"-map", "0:v:0", "-map", "1:a?", "-map_metadata", "1",
+		"-c:v", "copy",
+		request.OutputPath,
+	}
+	if err := runFFmpeg(args, request.Log, ui, nil); err != nil {
+		return fmt.Errorf("Joining video chunks failed: %w", err)
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"os"
+	"time"
 
 	shrinker "go.hasen.dev/media_shrinker"
 )
@@ -17,9 +18,50 @@ func main() {
 	f.StringVar(&opts.SrcDir, "src", ".", "The directory with the source media files")
 	f.StringVar(&opts.DstDir, "dst", "./smaller", "The directory where compressed media files are to be placed")
 	f.StringVar(&opts.TmpDir, "tmp", "./_temp_", "The directory where compressed media files are to be placed while being processed")
+	f.StringVar(&opts.FFmpegPath, "ffmpeg", os.Getenv("SHRINKER_FFMPEG"), "Path of the ffmpeg binary (default: $SHRINKER_FFMPEG, or ffmpeg from PATH)")
+	f.StringVar(&opts.CWebPPath, "cwebp", os.Getenv("SHRINKER_CWEBP"), "Path of the cwebp binary, used for webp images (default: $SHRINKER_CWEBP, or cwebp from PATH)")
+	f.StringVar(&opts.AVIFEncPath, "avifenc", os.Getenv("SHRINKER_AVIFENC"), "Path of the avifenc binary, used for avif images (default: $SHRINKER_AVIFENC, or avifenc from PATH)")
+	f.StringVar(&opts.AVIFDecPath, "avifdec", os.Getenv("SHRINKER_AVIFDEC"), "Path of the avifdec binary, used to verify avif images when ffmpeg can't decode them (default: $SHRINKER_AVIFDEC, or avifdec from PATH)")
+	f.StringVar(&opts.CJpegPath, "cjpeg", os.Getenv("SHRINKER_CJPEG"), "Path of a cjpeg compatible encoder (like mozjpeg's) for jpg images, needed for subsampling=444; the built-in encoder is used if not set (default: $SHRINKER_CJPEG)")
+	f.StringVar(&opts.JPEGTranPath, "jpegtran", os.Getenv("SHRINKER_JPEGTRAN"), "Path of the jpegtran binary, used to optimize jpg images that need no resizing without re-encoding them (default: $SHRINKER_JPEGTRAN, or jpegtran from PATH)")
+	f.StringVar(&opts.FFprobePath, "ffprobe", os.Getenv("SHRINKER_FFPROBE"), "Path of the ffprobe binary (default: $SHRINKER_FFPROBE, or ffprobe from PATH)")
+	f.IntVar(&opts.Resources.Threads, "threads", 0, "Number of threads each ffmpeg process may use (0 lets ffmpeg decide)")
+	f.IntVar(&opts.Resources.Nice, "nice", 0, "CPU scheduling priority of ffmpeg processes, from -20 to 19 like the nice command (0 leaves it alone)")
+	f.StringVar(&opts.Resources.IOPriority, "ionice", "", "I/O scheduling class of ffmpeg processes: \"idle\" or \"best-effort:N\" with N from 0 to 7")
+	maxMemoryMB := f.Int("max-mem", 0, "Maximum memory (address space) of each ffmpeg process, in MB (0 for no limit)")
+	f.DurationVar(&opts.Resources.MaxCPUTime, "max-cpu-time", 0, "Maximum CPU time of each ffmpeg process (0 for no limit)")
+	f.StringVar(&opts.LogsDir, "logs", "", "The directory where the ffmpeg output is logged for files that failed (default: \"logs\" in the -tmp directory)")
+	f.StringVar(&opts.ThumbsDir, "thumbs", "", "The directory where a poster frame of every shrunk video and a thumbnail of every shrunk image are placed (none if empty)")
 	f.BoolVar(&opts.DoClean, "clean", false, "Delete processed source media files")
 	f.BoolVar(&opts.ReportOnly, "report-only", false, "Report current status without further processing any file")
+	f.BoolVar(&opts.Estimate, "estimate", false, "Estimate output size and processing time by encoding samples, without processing any file")
+	f.IntVar(&opts.ChunkJobs, "chunk-jobs", 3, "Number of ffmpeg processes encoding chunks of a long video at the same time")
+	f.DurationVar(&opts.ChunkMinDuration, "chunk-min", 10*time.Minute, "Videos at least this long are encoded in chunks")
+	f.DurationVar(&opts.ChunkDuration, "chunk-length", time.Minute, "Approximate length of each video chunk")
+	f.BoolVar(&opts.Resume, "resume", true, "Keep the encoded chunks of long videos so an interrupted run can resume where it stopped")
+	f.StringVar(&opts.VideoMode, "video-mode", shrinker.EncodeMode, "\"encode\" to shrink videos, \"remux\" to only copy their video and audio into a clean mp4 without any quality loss, or \"hls\" to make a package of several renditions for adaptive streaming")
+	opts.CameraProfile = shrinker.DefaultCameraProfile
+	opts.ScreenProfile = shrinker.DefaultScreenProfile
+	f.Var(&opts.CameraProfile, "camera-profile", "Encoder settings for camera videos, as a list like \"crf=26,preset=slow,tune=film,fps=30\"")
+	f.Var(&opts.ScreenProfile, "screen-profile", "Encoder settings for screen recordings and low motion videos, in the same format as -camera-profile")
+	f.Var(shrinker.FilterChain{Profile: &opts.CameraProfile}, "camera-filters", "ffmpeg filters applied to camera videos before scaling, like \"hqdn3d,autocrop\" (autocrop removes detected black bars)")
+	f.Var(shrinker.FilterChain{Profile: &opts.ScreenProfile}, "screen-filters", "ffmpeg filters applied to screen recordings and low motion videos before scaling, like -camera-filters")
+	f.BoolVar(&opts.DetectScreen, "detect-screen", true, "Detect screen recordings and low motion videos and use -screen-profile for them")
+	f.BoolVar(&opts.MotionAnalysis, "motion-analysis", false, "Also detect low motion videos by decoding their first seconds (slower)")
+	f.StringVar(&opts.AudioCodec, "audio-codec", shrinker.OpusCodec, "Codec for audio files: \"opus\" (falls back to aac if ffmpeg lacks libopus) or \"aac\"")
+	f.IntVar(&opts.AudioBitrate, "audio-bitrate", 24, "Bitrate for audio files in kbps; the default suits speech")
+	f.BoolVar(&opts.AudioMono, "audio-mono", false, "Downmix audio files to a single channel, as fits voice recordings")
+	opts.PhotoPolicy = shrinker.DefaultPhotoPolicy
+	opts.GraphicPolicy = shrinker.DefaultGraphicPolicy
+	f.Var(&opts.PhotoPolicy, "photo-policy", "Sizing and encoding of jpg images, as a list like \"long=3000,short=2000,mp=8,quality=85,subsampling=420,filter=lanczos3\"; without size limits they're scaled to 2048 pixels wide, or 1080 if portrait. ssim=0.98 searches for the lowest quality that keeps that SSIM instead of a fixed one. format=webp|avif changes the output format, with lossless=true|false for webp and speed=0-10 for avif")
+	f.Var(&opts.GraphicPolicy, "graphic-policy", "Sizing and encoding of png images, in the same format as -photo-policy, plus png=best|default|fast|none for the compression level, optimize=true|false to try smaller lossless encodings, photos=jpg|png for png images that are photos (jpg shrinks them with -photo-policy), and palette=2-256 to quantize the colours, if that keeps the ssim (0.98 by default)")
+	f.StringVar(&opts.ColorProfile, "color-profile", shrinker.KeepColorProfile, "Colour profiles of images: \"keep\" to embed them in the shrunk image, or \"srgb\" to convert the colours to sRGB")
+	f.StringVar(&opts.QualityMetric, "quality-check", "", "Compare shrunk videos against the original using \"ssim\" or \"psnr\" (disabled if empty)")
+	f.Float64Var(&opts.QualityFloor, "quality-floor", 0, "Re-encode at a higher quality if the score is below this (default: 0.96 for ssim, 38 for psnr)")
+	f.IntVar(&opts.QualitySamples, "quality-samples", 4, "Number of short windows spread over each video to compare")
+	f.IntVar(&opts.QualityRetries, "quality-retries", 2, "Maximum number of re-encodes when the quality is below the floor")
 	f.Parse(args)
+	opts.Resources.MaxMemory = *maxMemoryMB * shrinker.MB
 
 	processor := shrinker.InitProcessorData(opts)
 
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"io"
+	"path/filepath"
 )
 
 func copyFile(inputPath string, outputPath string) error {
@@ -20,3 +21,18 @@ func copyFile(inputPath string, outputPath string) error {
 	_, err = io.Copy(outFile, inputFile)
 	return err
 }
+
+// pathSize is the size of a file, or the total size of the files in a directory
+func pathSize(p string) (int, error) {
+	var size int64
+	err := filepath.Walk(p, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return int(size), err
+}
@@ -0,0 +1,231 @@
+package media_shrinker
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"time"
+)
+
+// Estimate mode: encode a few short samples of every video and a subset of the images and audio files,
+// and extrapolate how big the output will be and how long it will take, without producing any output.
+
+const (
+	estimateVideoSamples  = 3  // per video
+	estimateSampleLength  = 5  // seconds per video sample
+	estimateSubsetSamples = 10 // per type of image or audio
+)
+
+func EstimateProcessing(proc *ProcessorData, ui UI) {
+	var videos []*MediaFile
+	others := make(map[MediaType][]*MediaFile)
+	for index := range proc.MediaFiles {
+		mediaFile := &proc.MediaFiles[index]
+		if mediaFile.Stage != Waiting {
+			continue
+		}
+		if mediaFile.Type == Video {
+			videos = append(videos, mediaFile)
+		} else {
+			others[mediaFile.Type] = append(others[mediaFile.Type], mediaFile)
+		}
+	}
+
+	ui.Logf("Estimating %d videos and %d other file types by sample encoding", len(videos), len(others))
+
+	for _, files := range others {
+		estimateSubset(proc, files, ui)
+	}
+	for _, mediaFile := range videos {
+		if err := estimateVideo(proc, mediaFile, ui); err != nil {
+			ui.Logf("Could not estimate %s: %v", mediaFile.Name, err)
+		}
+		ui.Update()
+	}
+
+	// pictures, videos and audio are processed at the same time, so the total time is the longest of them
+	var stats ShrunkStats
+	var videosTime, imagesTime, audiosTime time.Duration
+	for _, mediaFile := range proc.MediaFiles {
+		if mediaFile.EstimatedSize == 0 {
+			continue
+		}
+		stats.Count++
+		stats.SizeBefore += mediaFile.Size
+		stats.SizeAfter += mediaFile.EstimatedSize
+		switch mediaFile.Type {
+		case Video:
+			videosTime += mediaFile.EstimatedTime
+		case Audio:
+			audiosTime += mediaFile.EstimatedTime
+		default:
+			imagesTime += mediaFile.EstimatedTime
+		}
+	}
+	totalTime := videosTime
+	if imagesTime > totalTime {
+		totalTime = imagesTime
+	}
+	if audiosTime > totalTime {
+		totalTime = audiosTime
+	}
+	ui.Logf("Estimated: %s in about %s", stats.ShrunkString(), FormatTime(totalTime.Seconds()))
+	ui.Update()
+}
+
+// estimateVideo encodes a few short windows of the video and extrapolates to its full duration
+func estimateVideo(proc *ProcessorData, mediaFile *MediaFile, ui UI) error {
+	inputPath := path.Join(mediaFile.Dir, mediaFile.Name)
+	info, err := ProbeVideoInfo(inputPath)
+	if err != nil {
+		return err
+	}
+	size := info.VideoSize
+	if size.Duration <= 0 {
+		return fmt.Errorf("unknown duration")
+	}
+	profile := chooseVideoProfile(&proc.Options, inputPath, &info, nil, ui)
+	mediaFile.Profile = profile.Name
+	filters := resolveFilters(profile.Filters, inputPath, &info, nil, ui)
+
+	samplePath := path.Join(proc.TmpDir, "estimate_"+OutputName(&proc.Options, mediaFile))
+	defer os.RemoveAll(samplePath)
+	hls := proc.VideoMode == HLSMode
+	renditions := hlsRenditions(&info)
+
+	var windows [][2]float64 // start, length
+	if size.Duration <= estimateVideoSamples*estimateSampleLength {
+		windows = append(windows, [2]float64{0, size.Duration})
+	} else {
+		for i := 0; i < estimateVideoSamples; i++ {
+			center := size.Duration * (float64(i) + 0.5) / estimateVideoSamples
+			windows = append(windows, [2]float64{center - estimateSampleLength/2.0, estimateSampleLength})
+		}
+	}
+
+	var sampledSeconds float64
+	var sampledBytes int64
+	var elapsed time.Duration
+	for _, window := range windows {
+		var args = []string{
+			"-y", "-ss", fmt.Sprintf("%.3f", window[0]), "-t", fmt.Sprintf("%.3f", window[1]),
+			"-i", inputPath,
+		}
+		if hls {
+			os.RemoveAll(samplePath)
+			for index := range renditions {
+				os.MkdirAll(path.Join(samplePath, fmt.Sprintf("v%d", index)), 0o755)
+			}
+			args = append(args, hlsEncodeArgs(&info, profile, filters, renditions, samplePath)...)
+		} else {
+			args = append(args, videoEncodeArgs(&info, profile, filters, profile.CRF)...)
+			args = append(args, samplePath)
+		}
+
+		startTime := time.Now()
+		if err := runFFmpeg(args, nil, ui, nil); err != nil {
+			return err
+		}
+		elapsed += time.Since(startTime)
+
+		sampleSize, err := pathSize(samplePath)
+		if err != nil {
+			return err
+		}
+		sampledSeconds += window[1]
+		sampledBytes += int64(sampleSize)
+	}
+
+	scale := size.Duration / sampledSeconds
+	mediaFile.EstimatedSize = int(float64(sampledBytes) * scale)
+	if !hls {
+		// bigger outputs are replaced by the original
+		mediaFile.EstimatedSize = minInt(mediaFile.EstimatedSize, mediaFile.Size)
+	}
+	mediaFile.EstimatedTime = time.Duration(float64(elapsed) * scale)
+	if !hls && useChunks(&proc.Options, size) && proc.ChunkJobs > 1 {
+		mediaFile.EstimatedTime /= time.Duration(proc.ChunkJobs)
+	}
+	return nil
+}
+
+// estimateSubset shrinks an evenly spread subset of the files (all of the same type),
+// and extrapolates the size ratio and the time per byte to the rest.
+func estimateSubset(proc *ProcessorData, files []*MediaFile, ui UI) {
+	step := (len(files) + estimateSubsetSamples - 1) / estimateSubsetSamples
+	if step < 1 {
+		step = 1
+	}
+
+	var bytesIn, bytesOut int
+	var elapsed time.Duration
+	for index := 0; index < len(files); index += step {
+		mediaFile := files[index]
+		mediaFile.OutputName = OutputName(&proc.Options, mediaFile)
+		samplePath := path.Join(proc.TmpDir, "estimate_"+mediaFile.OutputName)
+		request := ProcessingRequest{
+			Target:     mediaFile,
+			InputPath:  path.Join(mediaFile.Dir, mediaFile.Name),
+			OutputPath: samplePath,
+			Options:    &proc.Options,
+		}
+
+		startTime := time.Now()
+		var err error
+		switch mediaFile.Type {
+		case JPG:
+			err = ShrinkJPG(request, ui)
+		case PNG:
+			err = ShrinkPNG(request, ui)
+		case Audio:
+			err = ShrinkAudio(request, ui)
+		default:
+			err = fmt.Errorf("unsupported media type: %v", mediaFile.Type)
+		}
+		took := time.Since(startTime)
+
+		// the output name can change while shrinking, like for png photos written as jpg
+		samplePath = path.Join(proc.TmpDir, "estimate_"+mediaFile.OutputName)
+
+		info, statErr := os.Stat(samplePath)
+		os.Remove(samplePath)
+		if err != nil || statErr != nil {
+			ui.Logf("Could not estimate %s: %v", mediaFile.Name, err)
+			continue
+		}
+
+		mediaFile.EstimatedSize = minInt(int(info.Size()), mediaFile.Size)
+		mediaFile.EstimatedTime = took
+		bytesIn += mediaFile.Size
+		bytesOut += mediaFile.EstimatedSize
+		elapsed += took
+		ui.Update()
+	}
+
+	if bytesIn == 0 {
+		return
+	}
+	ratio := float64(bytesOut) / float64(bytesIn)
+	timePerByte := float64(elapsed) / float64(bytesIn)
+	for _, mediaFile := range files {
+		if mediaFile.EstimatedSize > 0 {
+			continue
+		}
+		mediaFile.EstimatedSize = int(float64(mediaFile.Size) * ratio)
+		mediaFile.EstimatedTime = time.Duration(float64(mediaFile.Size) * timePerByte)
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,96 @@
+package media_shrinker
+
+import (
+	"fmt"
+	"strings"
+)
+
+// User configurable video filters (denoising, cropping, sharpening, ...) that run before the automatic scaling.
+//
+// ffmpeg rotates phone videos upright before any filter runs, so the filters and the scaling
+// always see the video the way it's displayed.
+
+// autocropFilter is not an ffmpeg filter; it's replaced by a crop filter for the black bars detected in the video
+const autocropFilter = "autocrop"
+
+// FilterChain is a flag.Value for the filters of a profile, in ffmpeg's syntax, like "hqdn3d=4:3:6:4.5,autocrop"
+type FilterChain struct {
+	Profile *VideoProfile
+}
+
+func (chain FilterChain) String() string {
+	if chain.Profile == nil {
+		return ""
+	}
+	return strings.Join(chain.Profile.Filters, ",")
+}
+
+func (chain FilterChain) Set(value string) error {
+	chain.Profile.Filters = nil
+	for _, filter := range strings.Split(value, ",") {
+		filter = strings.TrimSpace(filter)
+		if filter != "" {
+			chain.Profile.Filters = append(chain.Profile.Filters, filter)
+		}
+	}
+	return nil
+}
+
+// resolveFilters replaces the autocrop placeholder with the crop detected in the video
+func resolveFilters(filters []string, inpath string, info *VideoInfo, log *FileLog, ui UI) []string {
+	var resolved []string
+	for _, filter := range filters {
+		if filter != autocropFilter {
+			resolved = append(resolved, filter)
+			continue
+		}
+		crop, err := DetectCrop(inpath, info, log, ui)
+		if err != nil {
+			ui.Logf("Could not detect black bars in %s: %v", inpath, err)
+			continue
+		}
+		if crop != "" {
+			ui.Logf("Cropping black bars of %s: %s", inpath, crop)
+			resolved = append(resolved, crop)
+		}
+	}
+	return resolved
+}
+
+const (
+	cropDetectStart  = 0.1 // fraction of the video to skip; intros and fades are often darker
+	cropDetectLength = 10  // seconds to analyse
+)
+
+// DetectCrop runs ffmpeg's cropdetect filter over a part of the video, and returns a crop filter
+// for the black bars, or an empty string if there are none
+func DetectCrop(inpath string, info *VideoInfo, log *FileLog, ui UI) (string, error) {
+	var args = []string{
+		"-ss", fmt.Sprintf("%.3f", info.Duration*cropDetectStart), "-t", fmt.Sprint(cropDetectLength),
+		"-i", inpath,
+		"-an", "-vf", "cropdetect=limit=24:round=2:reset=0", "-f", "null", "-",
+	}
+	output, err := ffmpegOutput(args, log, ui)
+	if err != nil {
+		return "", err
+	}
+
+	// cropdetect keeps printing its current guess, like:
+	//    [Parsed_cropdetect_0 @ 0x...] x1:0 x2:1919 y1:140 y2:939 w:1920 h:800 x:0 y:140 pts:... t:... crop=1920:800:0:140
+	cropIndex := strings.LastIndex(output, "crop=")
+	if cropIndex == -1 {
+		return "", fmt.Errorf("no crop detected in ffmpeg output")
+	}
+	fields := strings.Fields(output[cropIndex:])
+	crop := fields[0]
+
+	var w, h, x, y int
+	if _, err := fmt.Sscanf(crop, "crop=%d:%d:%d:%d", &w, &h, &x, &y); err != nil {
+		return "", fmt.Errorf("could not parse %q: %w", crop, err)
+	}
+	width, height := info.DisplaySize()
+	if w <= 0 || h <= 0 || (w == width && h == height) {
+		return "", nil
+	}
+	return crop, nil
+}
@@ -5,7 +5,7 @@ go 1.14
 require (
 	gioui.org v0.0.0-20201211192434-745bb949bb45
 	github.com/disintegration/imageorient v0.0.0-20180920195336-8147d86e83ec
-	github.com/gdamore/tcell/v2 v2.2.0 // indirect
-	github.com/mattn/go-runewidth v0.0.10 // indirect
+	github.com/gdamore/tcell/v2 v2.2.0
+	github.com/mattn/go-runewidth v0.0.10
 	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646
 )
@@ -0,0 +1,272 @@
+package media_shrinker
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// HLS mode makes every video a package for adaptive streaming: a directory named like the video
+// with a ".hls" extension, holding a master playlist and one segmented rendition per size, like:
+//
+//    VID_20191207_115139.hls/master.m3u8
+//    VID_20191207_115139.hls/v0/index.m3u8
+//    VID_20191207_115139.hls/v0/segment000.ts
+//    ...
+//
+// The package directory is the output of the video: it's only moved into DstDir once every
+// rendition was verified, so its presence there means the video is done.
+
+const (
+	HLSMode = "hls"
+
+	hlsExt            = ".hls"
+	hlsMasterPlaylist = "master.m3u8"
+	hlsSegmentLength  = 6 // seconds; every segment starts with a keyframe so players can switch renditions
+)
+
+type hlsRendition struct {
+	ShortEdge    int // height of landscape videos, width of portrait ones
+	VideoBitrate int // kbps
+	AudioBitrate int // kbps
+}
+
+// The rendition ladder, from the best to the worst. Renditions bigger than the video are skipped.
+var hlsLadder = []hlsRendition{
+	{ShortEdge: 1080, VideoBitrate: 5000, AudioBitrate: 128},
+	{ShortEdge: 720, VideoBitrate: 2800, AudioBitrate: 128},
+	{ShortEdge: 480, VideoBitrate: 1400, AudioBitrate: 96},
+	{ShortEdge: 360, VideoBitrate: 800, AudioBitrate: 64},
+}
+
+// hlsRenditions picks the renditions of the ladder that fit the video, and at least the smallest one
+func hlsRenditions(info *VideoInfo) []hlsRendition {
+	width, height := info.DisplaySize()
+	shortEdge := minInt(width, height)
+
+	var renditions []hlsRendition
+	for _, rendition := range hlsLadder {
+		if rendition.ShortEdge <= shortEdge {
+			renditions = append(renditions, rendition)
+		}
+	}
+	if len(renditions) == 0 {
+		smallest := hlsLadder[len(hlsLadder)-1]
+		smallest.ShortEdge = shortEdge - shortEdge%2
+		renditions = append(renditions, smallest)
+	}
+	return renditions
+}
+
+// hlsEncodeArgs returns the ffmpeg output arguments that write the package into outDir.
+// filters are the profile's filters, already resolved for this video; they run once, before
+// the video is split into the renditions.
+func hlsEncodeArgs(info *VideoInfo, profile *VideoProfile, filters []string, renditions []hlsRendition, outDir string) []string {
+	width, height := info.DisplaySize()
+
+	var chain []string
+	capFrameRate := profile.MaxFrameRate > 0 && info.FrameRate > profile.MaxFrameRate
+	if capFrameRate {
+		chain = append(chain, fmt.Sprintf("fps=%g", profile.MaxFrameRate))
+	}
+	chain = append(chain, filters...)
+	chain = append(chain, fmt.Sprintf("split=%d", len(renditions)))
+
+	graph := "[0:v]" + strings.Join(chain, ",")
+	for index := range renditions {
+		graph += fmt.Sprintf("[s%d]", index)
+	}
+	for index, rendition := range renditions {
+		scale := fmt.Sprintf("scale=-2:%d", rendition.ShortEdge)
+		if width < height { // vertical video
+			scale = fmt.Sprintf("scale=%d:-2", rendition.ShortEdge)
+		}
+		graph += fmt.Sprintf(";[s%d]%s[v%d]", index, scale, index)
+	}
+
+	var args = []string{"-filter_complex", graph}
+	var streamMap []string
+	for index := range renditions {
+		args = append(args, "-map", fmt.Sprintf("[v%d]", index))
+		variant := fmt.Sprintf("v:%d", index)
+		if info.HasAudio {
+			args = append(args, "-map", "0:a:0")
+			variant += fmt.Sprintf(",a:%d", index)
+		}
+		streamMap = append(streamMap, variant)
+	}
+
+	args = append(args, "-c:v", "libx264")
+	if profile.Preset != "" {
+		args = append(args, "-preset", profile.Preset)
+	}
+	if profile.Tune != "" {
+		args = append(args, "-tune", profile.Tune)
+	}
+	for index, rendition := range renditions {
+		// players pick a rendition by its bandwidth, so the bitrate has to be capped rather than left to crf
+		args = append(args,
+			fmt.Sprintf("-b:v:%d", index), fmt.Sprintf("%dk", rendition.VideoBitrate),
+			fmt.Sprintf("-maxrate:v:%d", index), fmt.Sprintf("%dk", rendition.VideoBitrate*107/100),
+			fmt.Sprintf("-bufsize:v:%d", index), fmt.Sprintf("%dk", rendition.VideoBitrate*3/2),
+		)
+		if info.HasAudio {
+			args = append(args, fmt.Sprintf("-b:a:%d", index), fmt.Sprintf("%dk", rendition.AudioBitrate))
+		}
+	}
+	if info.HasAudio {
+		args = append(args, "-c:a", "aac", "-ac", "2")
+	}
+	args = append(args, "-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", hlsSegmentLength))
+	if info.VariableFrameRate && !capFrameRate {
+		args = append(args, passthroughTimestampsArgs()...)
+	}
+
+	args = append(args,
+		"-f", "hls",
+		"-hls_time", fmt.Sprint(hlsSegmentLength),
+		"-hls_playlist_type", "vod",
+		"-hls_flags", "independent_segments",
+		"-hls_segment_filename", path.Join(outDir, "v%v", "segment%03d.ts"),
+		"-master_pl_name", hlsMasterPlaylist,
+		"-var_stream_map", strings.Join(streamMap, " "),
+		path.Join(outDir, "v%v", "index.m3u8"),
+	)
+	return args
+}
+
+// ShrinkMovieHLS writes the package into request.OutputPath, which is a directory
+func ShrinkMovieHLS(request ProcessingRequest, info *VideoInfo, ui UI) error {
+	opts := request.Options
+	profile := chooseVideoProfile(opts, request.InputPath, info, request.Log, ui)
+	request.Target.Profile = profile.Name
+	filters := resolveFilters(profile.Filters, request.InputPath, info, request.Log, ui)
+	renditions := hlsRenditions(info)
+
+	// leftovers of an interrupted run would end up in the package
+	outDir := request.OutputPath
+	if err := os.RemoveAll(outDir); err != nil {
+		return fmt.Errorf("Could not clear the HLS package directory: %w", err)
+	}
+	for index := range renditions {
+		if err := os.MkdirAll(path.Join(outDir, fmt.Sprintf("v%d", index)), 0o755); err != nil {
+			return fmt.Errorf("Could not create the HLS package directory: %w", err)
+		}
+	}
+
+	var args = []string{"-y", "-i", request.InputPath}
+	args = append(args, hlsEncodeArgs(info, profile, filters, renditions, outDir)...)
+	err := runFFmpeg(args, request.Log, ui, func(durationProcessed float64) {
+		request.Target.Percentage = (durationProcessed / info.Duration) * 100
+		request.Target.Processed = durationProcessed
+		ui.Update()
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := checkHLSPackage(outDir, info, renditions); err != nil {
+		return fmt.Errorf("Conversion failed; %w", err)
+	}
+	return nil
+}
+
+// checkHLSPackage makes sure the master playlist lists every rendition, and that every rendition
+// has the expected size, the whole duration, and audio in sync
+func checkHLSPackage(outDir string, info *VideoInfo, renditions []hlsRendition) error {
+	variants, err := readMasterPlaylist(path.Join(outDir, hlsMasterPlaylist))
+	if err != nil {
+		return err
+	}
+	if len(variants) != len(renditions) {
+		return fmt.Errorf("master playlist lists %d renditions instead of %d", len(variants), len(renditions))
+	}
+
+	for index, rendition := range renditions {
+		out, err := ProbeVideoInfo(path.Join(outDir, variants[index]))
+		if err != nil {
+			return fmt.Errorf("rendition %s: %w", variants[index], err)
+		}
+		if !DurationsRoughlyEqual(info.Duration, out.Duration) {
+			return fmt.Errorf("rendition %s: duration mismatch: %8.2f -> %8.2f", variants[index], info.Duration, out.Duration)
+		}
+		width, height := out.DisplaySize()
+		if minInt(width, height) != rendition.ShortEdge {
+			return fmt.Errorf("rendition %s: expected %dp, got %dx%d", variants[index], rendition.ShortEdge, width, height)
+		}
+
+		// MPEG-TS timestamps don't start at zero, so only the timing relative to the video is comparable
+		shift := out.VideoStart - info.VideoStart
+		out.VideoStart -= shift
+		out.AudioStart -= shift
+		if err := CheckAVSync(info, &out); err != nil {
+			return fmt.Errorf("rendition %s: %w", variants[index], err)
+		}
+	}
+	return nil
+}
+
+// readMasterPlaylist returns the playlists of the renditions, in order. Each one is on the line after its
+// #EXT-X-STREAM-INF tag, like:
+//
+//    #EXT-X-STREAM-INF:BANDWIDTH=5478400,RESOLUTION=1920x1080,CODECS="avc1.640028,mp4a.40.2"
+//    v0/index.m3u8
+//
+func readMasterPlaylist(playlistPath string) ([]string, error) {
+	file, err := os.Open(playlistPath)
+	if err != nil {
+		return nil, fmt.Errorf("master playlist missing: %w", err)
+	}
+	defer file.Close()
+
+	var variants []string
+	streamInf := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF"):
+			streamInf = true
+		case line == "" || strings.HasPrefix(line, "#"):
+		case streamInf:
+			variants = append(variants, line)
+			streamInf = false
+		}
+	}
+	return variants, scanner.Err()
+}
+
+// hlsPosterSource is what the poster of the video is made from: the master playlist of a package
+func hlsPosterSource(outputPath string) string {
+	if strings.HasSuffix(outputPath, hlsExt) {
+		return path.Join(outputPath, hlsMasterPlaylist)
+	}
+	return outputPath
+}
+
+// ListHLSPackages finds the complete packages in dir, and returns the size of each
+func ListHLSPackages(dir string) (map[string]int, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing directory %s: %w", dir, err)
+	}
+	packages := make(map[string]int)
+	for _, entry := range entries {
+		if !entry.IsDir() || path.Ext(entry.Name()) != hlsExt {
+			continue
+		}
+		packagePath := path.Join(dir, entry.Name())
+		if _, err := os.Stat(path.Join(packagePath, hlsMasterPlaylist)); err != nil {
+			continue
+		}
+		size, err := pathSize(packagePath)
+		if err != nil {
+			continue
+		}
+		packages[entry.Name()] = size
+	}
+	return packages, nil
+}
@@ -0,0 +1,513 @@
+package media_shrinker
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+// Colour profiles of images. Newer phones take photos in wider gamuts like Display P3, and
+// without their ICC profile the colours are shown as if they were sRGB, which looks dull.
+//
+// The profile is either embedded in the shrunk image as it is, or the pixels are converted
+// to sRGB, which every viewer assumes for images without a profile. Conversion only handles
+// matrix/TRC profiles, which is what cameras and phones use; for anything else the profile is kept.
+
+const (
+	KeepColorProfile = "keep"
+	SRGBColorProfile = "srgb"
+)
+
+const (
+	jpegAPP2         = 0xE2
+	iccChunkCapacity = 0xFFFF - 2 - 14 // segment length, then the header and the chunk numbers
+)
+
+var iccJPEGHeader = []byte("ICC_PROFILE\x00")
+
+// readColorProfile returns the ICC profile embedded in the image, or nil if there's none
+func readColorProfile(inpath string, mtype MediaType) ([]byte, error) {
+	file, err := os.Open(inpath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	switch mtype {
+	case JPG:
+		segments, err := readJPEGSegments(file)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read colour profile of %s: %w", inpath, err)
+		}
+		return jpegColorProfile(segments), nil
+	case PNG:
+		chunks, err := readPNGChunks(file)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read colour profile of %s: %w", inpath, err)
+		}
+		for _, chunk := range chunks {
+			if chunk.Type == "iCCP" {
+				profile, err := pngColorProfile(chunk.Data)
+				if err != nil {
+					return nil, fmt.Errorf("Could not read colour profile of %s: %w", inpath, err)
+				}
+				return profile, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// jpegColorProfile puts together the profile, which is split over APP2 segments
+// when it doesn't fit in one; each has its sequence number and the number of segments
+func jpegColorProfile(segments []jpegSegment) []byte {
+	var chunks []jpegSegment
+	for _, segment := range segments {
+		if segment.Marker == jpegAPP2 && bytes.HasPrefix(segment.Data, iccJPEGHeader) && len(segment.Data) > len(iccJPEGHeader)+2 {
+			chunks = append(chunks, segment)
+		}
+	}
+	if len(chunks) == 0 {
+		return nil
+	}
+	sort.SliceStable(chunks, func(i, j int) bool {
+		return chunks[i].Data[len(iccJPEGHeader)] < chunks[j].Data[len(iccJPEGHeader)]
+	})
+	var profile []byte
+	for _, chunk := range chunks {
+		profile = append(profile, chunk.Data[len(iccJPEGHeader)+2:]...)
+	}
+	return profile
+}
+
+// iccJPEGSegments splits the profile into APP2 segments
+func iccJPEGSegments(profile []byte) []jpegSegment {
+	count := (len(profile) + iccChunkCapacity - 1) / iccChunkCapacity
+	if count > 255 {
+		return nil
+	}
+	var segments []jpegSegment
+	for index := 0; index < count; index++ {
+		chunk := profile[index*iccChunkCapacity:]
+		if len(chunk) > iccChunkCapacity {
+			chunk = chunk[:iccChunkCapacity]
+		}
+		data := append([]byte{}, iccJPEGHeader...)
+		data = append(data, byte(index+1), byte(count))
+		data = append(data, chunk...)
+		segments = append(segments, jpegSegment{Marker: jpegAPP2, Data: data})
+	}
+	return segments
+}
+
+// The iCCP chunk is the name of the profile, a null, the compression method (always zlib), then the compressed profile
+func pngColorProfile(data []byte) ([]byte, error) {
+	nameEnd := bytes.IndexByte(data, 0)
+	if nameEnd == -1 || nameEnd+2 > len(data) {
+		return nil, fmt.Errorf("invalid iCCP chunk")
+	}
+	reader, err := zlib.NewReader(bytes.NewReader(data[nameEnd+2:]))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+func iccPNGChunk(profile []byte) pngChunk {
+	var data bytes.Buffer
+	data.WriteString("ICC profile\x00\x00")
+	compressor := zlib.NewWriter(&data)
+	compressor.Write(profile)
+	compressor.Close()
+	return pngChunk{Type: "iCCP", Data: data.Bytes()}
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+type pngChunk struct {
+	Type string
+	Data []byte
+}
+
+// readPNGChunks reads the chunks before the image data
+func readPNGChunks(r io.Reader) ([]pngChunk, error) {
+	reader := bufio.NewReader(r)
+	signature := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(reader, signature); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(signature, pngSignature) {
+		return nil, fmt.Errorf("not a png file")
+	}
+
+	var chunks []pngChunk
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			return nil, err
+		}
+		length := binary.BigEndian.Uint32(header[:4])
+		chunkType := string(header[4:])
+		if chunkType == "IDAT" || chunkType == "IEND" {
+			return chunks, nil
+		}
+		if length > 1<<26 {
+			return nil, fmt.Errorf("png chunk %s too big", chunkType)
+		}
+		data := make([]byte, length+4) // with the crc
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, pngChunk{Type: chunkType, Data: data[:length]})
+	}
+}
+
+func writePNGChunk(w io.Writer, chunk pngChunk) {
+	binary.Write(w, binary.BigEndian, uint32(len(chunk.Data)))
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(chunk.Type))
+	crc.Write(chunk.Data)
+	w.Write([]byte(chunk.Type))
+	w.Write(chunk.Data)
+	binary.Write(w, binary.BigEndian, crc.Sum32())
+}
+
+// pngChunkWriter writes the chunks right after the IHDR chunk of the png written through it,
+// since the ones we add have to come before the image data
+type pngChunkWriter struct {
+	w      io.Writer
+	chunks []pngChunk
+	header []byte // the signature and the IHDR chunk, until they went through
+}
+
+const pngHeaderLength = 8 + 4 + 4 + 13 + 4 // signature, then IHDR: length, type, data, crc
+
+func (cw *pngChunkWriter) Write(p []byte) (int, error) {
+	if cw.chunks == nil {
+		return cw.w.Write(p)
+	}
+
+	written := 0
+	for len(cw.header) < pngHeaderLength && len(p) > 0 {
+		cw.header = append(cw.header, p[0])
+		p = p[1:]
+		written++
+	}
+	if len(cw.header) < pngHeaderLength {
+		return written, nil
+	}
+
+	var buffer bytes.Buffer
+	buffer.Write(cw.header)
+	for _, chunk := range cw.chunks {
+		writePNGChunk(&buffer, chunk)
+	}
+	cw.chunks = nil
+	if _, err := cw.w.Write(buffer.Bytes()); err != nil {
+		return written, err
+	}
+	n, err := cw.w.Write(p)
+	return written + n, err
+}
+
+// colorProfileNeedsConversion tells whether the colours of images with this profile are converted to sRGB
+func colorProfileNeedsConversion(opts *Options, profile []byte) bool {
+	return opts.ColorProfile == SRGBColorProfile && !strings.Contains(iccDescription(profile), "sRGB")
+}
+
+// applyColorProfile converts the image to sRGB if asked to, and returns the profile to embed, if any
+func applyColorProfile(request ProcessingRequest, img image.Image, profile []byte, ui UI) (image.Image, []byte) {
+	name := iccDescription(profile)
+	request.Target.ColorProfile = name
+	if request.Options.ColorProfile != SRGBColorProfile {
+		return img, profile
+	}
+	if !colorProfileNeedsConversion(request.Options, profile) {
+		// what viewers assume anyway
+		return img, nil
+	}
+
+	converted, err := convertToSRGB(img, profile)
+	if err != nil {
+		ui.Logf("Keeping the colour profile of %s; it can't be converted: %v", request.Target.Name, err)
+		return img, profile
+	}
+	request.Target.ColorProfile = name + " -> sRGB"
+	return converted, nil
+}
+
+// ICC profiles start with a 128 byte header, followed by the tag table
+const iccHeaderLength = 128
+
+type iccProfile struct {
+	data []byte
+	tags map[string][]byte
+}
+
+func parseICC(profile []byte) (*iccProfile, error) {
+	if len(profile) < iccHeaderLength+4 {
+		return nil, fmt.Errorf("profile too short")
+	}
+	icc := &iccProfile{data: profile, tags: make(map[string][]byte)}
+	count := int(binary.BigEndian.Uint32(profile[iccHeaderLength:]))
+	for index := 0; index < count; index++ {
+		entry := iccHeaderLength + 4 + index*12
+		if entry+12 > len(profile) {
+			return nil, fmt.Errorf("tag table truncated")
+		}
+		signature := string(profile[entry : entry+4])
+		offset := int(binary.BigEndian.Uint32(profile[entry+4:]))
+		size := int(binary.BigEndian.Uint32(profile[entry+8:]))
+		if offset < 0 || size < 8 || offset+size > len(profile) {
+			return nil, fmt.Errorf("tag %q out of bounds", signature)
+		}
+		icc.tags[signature] = profile[offset : offset+size]
+	}
+	return icc, nil
+}
+
+// colorSpace is like "RGB " or "GRAY"
+func (icc *iccProfile) colorSpace() string {
+	return string(icc.data[16:20])
+}
+
+// iccDescription returns the name of the profile, like "Display P3"
+func iccDescription(profile []byte) string {
+	icc, err := parseICC(profile)
+	if err != nil {
+		return "unknown profile"
+	}
+	desc := icc.tags["desc"]
+	switch {
+	case desc == nil:
+	case string(desc[:4]) == "desc" && len(desc) >= 12:
+		// ICC v2: the length (with the null) then ascii text
+		length := int(binary.BigEndian.Uint32(desc[8:]))
+		if 12+length <= len(desc) {
+			return strings.TrimRight(string(desc[12:12+length]), "\x00")
+		}
+	case string(desc[:4]) == "mluc" && len(desc) >= 28:
+		// ICC v4: utf-16 text in several languages; take the first
+		length := int(binary.BigEndian.Uint32(desc[20:]))
+		offset := int(binary.BigEndian.Uint32(desc[24:]))
+		if offset+length <= len(desc) {
+			text := make([]uint16, length/2)
+			for index := range text {
+				text[index] = binary.BigEndian.Uint16(desc[offset+index*2:])
+			}
+			return strings.TrimRight(string(utf16.Decode(text)), "\x00")
+		}
+	}
+	return "unknown profile"
+}
+
+// s15Fixed16 is the fixed point number type of ICC profiles
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+// colorant reads an XYZ tag
+func (icc *iccProfile) colorant(signature string) ([3]float64, error) {
+	var xyz [3]float64
+	tag := icc.tags[signature]
+	if len(tag) < 20 || string(tag[:4]) != "XYZ " {
+		return xyz, fmt.Errorf("no %s colorant", signature)
+	}
+	for index := range xyz {
+		xyz[index] = s15Fixed16(tag[8+index*4:])
+	}
+	return xyz, nil
+}
+
+// toneCurve reads a TRC tag into a table from 8 bit values to linear light
+func (icc *iccProfile) toneCurve(signature string) (*[256]float64, error) {
+	tag := icc.tags[signature]
+	if len(tag) < 12 {
+		return nil, fmt.Errorf("no %s tone curve", signature)
+	}
+
+	var curve func(x float64) float64
+	switch string(tag[:4]) {
+	case "curv":
+		count := int(binary.BigEndian.Uint32(tag[8:]))
+		if 12+count*2 > len(tag) {
+			return nil, fmt.Errorf("%s tone curve truncated", signature)
+		}
+		switch count {
+		case 0:
+			curve = func(x float64) float64 { return x }
+		case 1:
+			gamma := float64(binary.BigEndian.Uint16(tag[12:])) / 256
+			curve = func(x float64) float64 { return math.Pow(x, gamma) }
+		default:
+			curve = func(x float64) float64 {
+				position := x * float64(count-1)
+				index := int(position)
+				if index >= count-1 {
+					return float64(binary.BigEndian.Uint16(tag[12+(count-1)*2:])) / 65535
+				}
+				low := float64(binary.BigEndian.Uint16(tag[12+index*2:]))
+				high := float64(binary.BigEndian.Uint16(tag[12+index*2+2:]))
+				fraction := position - float64(index)
+				return (low + (high-low)*fraction) / 65535
+			}
+		}
+	case "para":
+		functionType := int(binary.BigEndian.Uint16(tag[8:]))
+		paramCounts := []int{1, 3, 4, 5, 7}
+		if functionType >= len(paramCounts) || 12+paramCounts[functionType]*4 > len(tag) {
+			return nil, fmt.Errorf("unsupported %s tone curve", signature)
+		}
+		var p [7]float64
+		for index := 0; index < paramCounts[functionType]; index++ {
+			p[index] = s15Fixed16(tag[12+index*4:])
+		}
+		g, a, b, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+		curve = func(x float64) float64 {
+			switch functionType {
+			case 0:
+				return math.Pow(x, g)
+			case 1:
+				if x >= -b/a {
+					return math.Pow(a*x+b, g)
+				}
+				return 0
+			case 2:
+				if x >= -b/a {
+					return math.Pow(a*x+b, g) + c
+				}
+				return c
+			case 3:
+				if x >= d {
+					return math.Pow(a*x+b, g)
+				}
+				return c * x
+			default:
+				if x >= d {
+					return math.Pow(a*x+b, g) + e
+				}
+				return c*x + f
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported %s tone curve", signature)
+	}
+
+	var table [256]float64
+	for index := range table {
+		table[index] = curve(float64(index) / 255)
+	}
+	return &table, nil
+}
+
+// The sRGB primaries, adapted to the D50 white of the ICC profile connection space, as columns
+var srgbToXYZ = [3][3]float64{
+	{0.4360747, 0.3850649, 0.1430804},
+	{0.2225045, 0.7168786, 0.0606169},
+	{0.0139322, 0.0971045, 0.7141733},
+}
+
+// convertToSRGB converts the pixels from the colours of the profile to sRGB.
+// The result has 8 bits per channel.
+func convertToSRGB(img image.Image, profile []byte) (image.Image, error) {
+	icc, err := parseICC(profile)
+	if err != nil {
+		return nil, err
+	}
+	if icc.colorSpace() != "RGB " {
+		return nil, fmt.Errorf("not an RGB profile")
+	}
+
+	var toXYZ [3][3]float64
+	var curves [3]*[256]float64
+	for channel, name := range []string{"r", "g", "b"} {
+		xyz, err := icc.colorant(name + "XYZ")
+		if err != nil {
+			return nil, err
+		}
+		for row := range xyz {
+			toXYZ[row][channel] = xyz[row]
+		}
+		curves[channel], err = icc.toneCurve(name + "TRC")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fromXYZ, err := invert3x3(srgbToXYZ)
+	if err != nil {
+		return nil, err
+	}
+	transform := multiply3x3(fromXYZ, toXYZ)
+
+	// from linear light back to 8 bit sRGB
+	const encodeSteps = 4096
+	var encode [encodeSteps + 1]uint8
+	for index := range encode {
+		linear := float64(index) / encodeSteps
+		var value float64
+		if linear <= 0.0031308 {
+			value = 12.92 * linear
+		} else {
+			value = 1.055*math.Pow(linear, 1/2.4) - 0.055
+		}
+		encode[index] = uint8(math.Round(value * 255))
+	}
+
+	bounds := img.Bounds()
+	out := image.NewNRGBA(bounds)
+	draw.Draw(out, bounds, img, bounds.Min, draw.Src)
+	for offset := 0; offset+3 < len(out.Pix); offset += 4 {
+		pixel := out.Pix[offset : offset+3]
+		linear := [3]float64{curves[0][pixel[0]], curves[1][pixel[1]], curves[2][pixel[2]]}
+		for channel := range linear {
+			value := transform[channel][0]*linear[0] + transform[channel][1]*linear[1] + transform[channel][2]*linear[2]
+			value = math.Max(0, math.Min(1, value)) // colours outside of sRGB are clipped
+			pixel[channel] = encode[int(math.Round(value*encodeSteps))]
+		}
+	}
+	return out, nil
+}
+
+func multiply3x3(a, b [3][3]float64) (out [3][3]float64) {
+	for row := 0; row < 3; row++ {
+		for col := 0; col < 3; col++ {
+			for k := 0; k < 3; k++ {
+				out[row][col] += a[row][k] * b[k][col]
+			}
+		}
+	}
+	return out
+}
+
+func invert3x3(m [3][3]float64) (out [3][3]float64, err error) {
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	if math.Abs(det) < 1e-12 {
+		return out, fmt.Errorf("singular matrix")
+	}
+	out[0][0] = (m[1][1]*m[2][2] - m[1][2]*m[2][1]) / det
+	out[0][1] = (m[0][2]*m[2][1] - m[0][1]*m[2][2]) / det
+	out[0][2] = (m[0][1]*m[1][2] - m[0][2]*m[1][1]) / det
+	out[1][0] = (m[1][2]*m[2][0] - m[1][0]*m[2][2]) / det
+	out[1][1] = (m[0][0]*m[2][2] - m[0][2]*m[2][0]) / det
+	out[1][2] = (m[0][2]*m[1][0] - m[0][0]*m[1][2]) / det
+	out[2][0] = (m[1][0]*m[2][1] - m[1][1]*m[2][0]) / det
+	out[2][1] = (m[0][1]*m[2][0] - m[0][0]*m[2][1]) / det
+	out[2][2] = (m[0][0]*m[1][1] - m[0][1]*m[1][0]) / det
+	return out, nil
+}
@@ -0,0 +1,348 @@
+package media_shrinker
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/nfnt/resize"
+)
+
+// How images are sized and encoded. Photos (jpg) and graphics like screenshots (png) get their own policy.
+//
+// Without any size limit, images keep the original rule: 2048 pixels wide, or 1080 for portrait images.
+
+type ImagePolicy struct {
+	Name string
+
+	// Size limits; the image is scaled down to fit all of them. Zero for no limit.
+	MaxLongEdge, MaxShortEdge int
+	MaxMegapixels             float64
+
+	// JPEG quality (1-100) and chroma subsampling ("420" or "444")
+	Quality     int
+	Subsampling string
+
+	// When set, jpg output uses the lowest quality whose SSIM stays at or above it, instead of Quality.
+	// It's also the floor for palette quantization (0.98 if not set).
+	TargetSSIM float64
+
+	// Resampling filter, see resampleFilters
+	Filter string
+
+	// PNG compression level, see pngCompressionLevels, and whether to look for a smaller
+	// lossless encoding (colour type and row filters), see optimizePNG
+	PNGCompression string
+	OptimizePNG    bool
+
+	// Whether png images that turn out to be photos are shrunk with the photo policy, see isPhotographic
+	PhotosAsJPEG bool
+
+	// Maximum colours of the palette png output is quantized to (up to 256), or zero to keep all colours
+	PaletteColors int
+
+	// Output format: empty to keep the format of the original, "webp" or "avif".
+	// Lossless only applies to webp; lossy webp and avif use Quality.
+	Format   string
+	Lossless bool
+
+	// Encoder speed of avif, from 0 (slowest, smallest) to 10
+	Speed int
+}
+
+var DefaultPhotoPolicy = ImagePolicy{
+	Name:           "photo",
+	Quality:        90,
+	Subsampling:    "420",
+	Filter:         "lanczos3",
+	PNGCompression: "best",
+	Speed:          6,
+}
+
+var DefaultGraphicPolicy = ImagePolicy{
+	Name:           "graphic",
+	Quality:        90,
+	Subsampling:    "420",
+	Filter:         "lanczos3",
+	PNGCompression: "best",
+	OptimizePNG:    true,
+	PhotosAsJPEG:   true,
+	Lossless:       true,
+	Speed:          6,
+}
+
+var resampleFilters = map[string]resize.InterpolationFunction{
+	"nearest":  resize.NearestNeighbor,
+	"bilinear": resize.Bilinear,
+	"bicubic":  resize.Bicubic,
+	"mitchell": resize.MitchellNetravali,
+	"lanczos2": resize.Lanczos2,
+	"lanczos3": resize.Lanczos3,
+}
+
+var pngCompressionLevels = map[string]png.CompressionLevel{
+	"default": png.DefaultCompression,
+	"none":    png.NoCompression,
+	"fast":    png.BestSpeed,
+	"best":    png.BestCompression,
+}
+
+// imagePolicyFor picks the policy for the image based on its type
+func imagePolicyFor(opts *Options, mediaFile *MediaFile) *ImagePolicy {
+	if mediaFile.Type == PNG {
+		return &opts.GraphicPolicy
+	}
+	return &opts.PhotoPolicy
+}
+
+// imageFormat is the format the image will be written in: "webp", "avif", or empty for the format of the original.
+// Like audioCodec, it falls back when the tools are missing, so output names are stable within a run.
+func imageFormat(opts *Options, mediaFile *MediaFile) string {
+	return policyFormat(imagePolicyFor(opts, mediaFile))
+}
+
+// policyFormat is the output format of the policy, or empty to keep the format of the file
+func policyFormat(policy *ImagePolicy) string {
+	if imageFormatAvailable(policy.Format) {
+		return policy.Format
+	}
+	return ""
+}
+
+func imageFormatAvailable(format string) bool {
+	switch format {
+	case WebPFormat:
+		return webpEncoderAvailable()
+	case AVIFFormat:
+		return avifEncoderAvailable()
+	}
+	return false
+}
+
+// String formats the policy the same way Set parses it
+func (policy *ImagePolicy) String() string {
+	if policy == nil {
+		return ""
+	}
+	var parts []string
+	if policy.MaxLongEdge > 0 {
+		parts = append(parts, fmt.Sprintf("long=%d", policy.MaxLongEdge))
+	}
+	if policy.MaxShortEdge > 0 {
+		parts = append(parts, fmt.Sprintf("short=%d", policy.MaxShortEdge))
+	}
+	if policy.MaxMegapixels > 0 {
+		parts = append(parts, fmt.Sprintf("mp=%g", policy.MaxMegapixels))
+	}
+	parts = append(parts,
+		fmt.Sprintf("quality=%d", policy.Quality),
+		"subsampling="+policy.Subsampling,
+	)
+	if policy.TargetSSIM > 0 {
+		parts = append(parts, fmt.Sprintf("ssim=%g", policy.TargetSSIM))
+	}
+	parts = append(parts,
+		"filter="+policy.Filter,
+		"png="+policy.PNGCompression,
+		fmt.Sprintf("optimize=%t", policy.OptimizePNG),
+	)
+	if policy.PhotosAsJPEG {
+		parts = append(parts, "photos=jpg")
+	}
+	if policy.PaletteColors > 0 {
+		parts = append(parts, fmt.Sprintf("palette=%d", policy.PaletteColors))
+	}
+	if policy.Format != "" {
+		parts = append(parts, "format="+policy.Format)
+	}
+	parts = append(parts, fmt.Sprintf("lossless=%t", policy.Lossless), fmt.Sprintf("speed=%d", policy.Speed))
+	return strings.Join(parts, ",")
+}
+
+// Set overrides settings of the policy from a list like "long=3000,mp=8,quality=85,subsampling=444,ssim=0.98,filter=lanczos3,png=best"
+func (policy *ImagePolicy) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		eq := strings.Index(item, "=")
+		if eq == -1 {
+			return fmt.Errorf("expected key=value, got %q", item)
+		}
+		key, val := item[:eq], item[eq+1:]
+		switch key {
+		case "long", "short":
+			edge, err := strconv.Atoi(val)
+			if err != nil || edge < 0 {
+				return fmt.Errorf("invalid %s edge %q", key, val)
+			}
+			if key == "long" {
+				policy.MaxLongEdge = edge
+			} else {
+				policy.MaxShortEdge = edge
+			}
+		case "mp":
+			megapixels, err := strconv.ParseFloat(val, 64)
+			if err != nil || megapixels < 0 {
+				return fmt.Errorf("invalid megapixels %q", val)
+			}
+			policy.MaxMegapixels = megapixels
+		case "quality":
+			quality, err := strconv.Atoi(val)
+			if err != nil || quality < 1 || quality > 100 {
+				return fmt.Errorf("invalid quality %q; expected 1 to 100", val)
+			}
+			policy.Quality = quality
+		case "subsampling":
+			if val != "420" && val != "444" {
+				return fmt.Errorf("invalid subsampling %q; expected 420 or 444", val)
+			}
+			policy.Subsampling = val
+		case "ssim":
+			target, err := strconv.ParseFloat(val, 64)
+			if err != nil || target < 0 || target >= 1 {
+				return fmt.Errorf("invalid target ssim %q; expected 0 (off) up to 1", val)
+			}
+			policy.TargetSSIM = target
+		case "filter":
+			if _, ok := resampleFilters[val]; !ok {
+				return fmt.Errorf("unknown resampling filter %q", val)
+			}
+			policy.Filter = val
+		case "png":
+			if _, ok := pngCompressionLevels[val]; !ok {
+				return fmt.Errorf("unknown png compression %q", val)
+			}
+			policy.PNGCompression = val
+		case "optimize":
+			optimize, err := strconv.ParseBool(val)
+			if err != nil {
+				return fmt.Errorf("invalid optimize %q: %w", val, err)
+			}
+			policy.OptimizePNG = optimize
+		case "photos":
+			if val != "jpg" && val != "png" {
+				return fmt.Errorf("invalid photos %q; expected jpg or png", val)
+			}
+			policy.PhotosAsJPEG = val == "jpg"
+		case "palette":
+			colors, err := strconv.Atoi(val)
+			if err != nil || colors < 0 || colors == 1 || colors > 256 {
+				return fmt.Errorf("invalid palette size %q; expected 0 (off) or 2 to 256", val)
+			}
+			policy.PaletteColors = colors
+		case "format":
+			switch val {
+			case "original":
+				policy.Format = ""
+			case WebPFormat, AVIFFormat:
+				policy.Format = val
+			default:
+				return fmt.Errorf("unknown image format %q", val)
+			}
+		case "lossless":
+			lossless, err := strconv.ParseBool(val)
+			if err != nil {
+				return fmt.Errorf("invalid lossless %q: %w", val, err)
+			}
+			policy.Lossless = lossless
+		case "speed":
+			speed, err := strconv.Atoi(val)
+			if err != nil || speed < 0 || speed > 10 {
+				return fmt.Errorf("invalid speed %q; expected 0 to 10", val)
+			}
+			policy.Speed = speed
+		default:
+			return fmt.Errorf("unknown image policy setting %q", key)
+		}
+	}
+	return nil
+}
+
+func (policy *ImagePolicy) hasSizeLimits() bool {
+	return policy.MaxLongEdge > 0 || policy.MaxShortEdge > 0 || policy.MaxMegapixels > 0
+}
+
+// targetWidth is the width to scale the image to; images are never scaled up
+func (policy *ImagePolicy) targetWidth(size image.Point) int {
+	if !policy.hasSizeLimits() {
+		desiredWidth := 2048
+		if size.Y > size.X { // vertical image
+			desiredWidth = 1080
+		}
+		return minInt(desiredWidth, size.X)
+	}
+
+	long, short := size.X, size.Y
+	if short > long {
+		long, short = short, long
+	}
+	scale := 1.0
+	if policy.MaxLongEdge > 0 {
+		scale = math.Min(scale, float64(policy.MaxLongEdge)/float64(long))
+	}
+	if policy.MaxShortEdge > 0 {
+		scale = math.Min(scale, float64(policy.MaxShortEdge)/float64(short))
+	}
+	if policy.MaxMegapixels > 0 {
+		scale = math.Min(scale, math.Sqrt(policy.MaxMegapixels*1e6/float64(size.X*size.Y)))
+	}
+	// resizing to a width of 0 would keep the image as it is
+	return maxInt(1, int(math.Round(float64(size.X)*scale)))
+}
+
+func (policy *ImagePolicy) resampleFilter() resize.InterpolationFunction {
+	if filter, ok := resampleFilters[policy.Filter]; ok {
+		return filter
+	}
+	return resize.Lanczos3
+}
+
+func (policy *ImagePolicy) pngCompressionLevel() png.CompressionLevel {
+	if level, ok := pngCompressionLevels[policy.PNGCompression]; ok {
+		return level
+	}
+	return png.BestCompression
+}
+
+// describe records how the image was shrunk, like "photo 2048x1536 q90 4:2:0 lanczos3 cjpeg".
+// format is the format of the output, and encoding is what the encoder actually did.
+func (policy *ImagePolicy) describe(format string, size image.Point, encoding imageEncoding) string {
+	settings := fmt.Sprintf("%s %dx%d", policy.Name, size.X, size.Y)
+	switch format {
+	case "png":
+		settings += " png=" + policy.PNGCompression
+		if encoding.Colors > 0 {
+			settings += fmt.Sprintf(" %d colours", encoding.Colors)
+		}
+	case WebPFormat:
+		if policy.Lossless {
+			settings += " webp lossless"
+		} else {
+			settings += fmt.Sprintf(" webp q%d", policy.Quality)
+		}
+	case AVIFFormat:
+		settings += fmt.Sprintf(" avif q%d speed %d", policy.Quality, policy.Speed)
+		if encoding.Unverified {
+			settings += " unverified"
+		}
+	default:
+		subsampling := encoding.Subsampling
+		settings += fmt.Sprintf(" q%d %s:%s:%s", policy.Quality, subsampling[:1], subsampling[1:2], subsampling[2:])
+	}
+	return settings + " " + policy.Filter + " " + encoding.Encoder
+}
+
+// saveImageSettings records the settings the image was shrunk with, see saveFileRecord
+func saveImageSettings(logsDir string, mediaFile *MediaFile) error {
+	return saveFileRecord(logsDir, mediaFile, "settings", mediaFile.ImageSettings)
+}
+
+// loadImageSettings reads back the settings saved by saveImageSettings, if there are any
+func loadImageSettings(logsDir string, mediaFile *MediaFile) {
+	mediaFile.ImageSettings = loadFileRecord(logsDir, mediaFile, "settings")
+}
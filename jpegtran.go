@@ -0,0 +1,148 @@
+package media_shrinker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Photos that are already within the size limits are not decoded and encoded again, which would
+// only lose quality for little gain. Their DCT coefficients are kept as they are: jpegtran (when
+// it's there) optimizes the Huffman tables and makes the scans progressive, and either way the
+// metadata is cleaned up like for the other photos, minus the thumbnail and the segments of
+// camera and editing apps.
+
+// losslessJPEG tells whether the jpg can be copied without decoding it: it needs no resizing, no
+// rotation, and no colour conversion. It returns the size and the colour profile of the jpg.
+func losslessJPEG(request ProcessingRequest, policy *ImagePolicy) (image.Point, []byte, bool) {
+	var size image.Point
+	if request.Target.Type != JPG || imageFormat(request.Options, request.Target) != "" {
+		return size, nil, false
+	}
+
+	file, err := os.Open(request.InputPath)
+	if err != nil {
+		return size, nil, false
+	}
+	defer file.Close()
+	segments, err := readJPEGSegments(file)
+	if err != nil || jpegOrientation(segments) != exifOrientationNone {
+		return size, nil, false
+	}
+	file.Seek(0, io.SeekStart)
+	config, err := jpeg.DecodeConfig(file)
+	if err != nil {
+		return size, nil, false
+	}
+	size = image.Pt(config.Width, config.Height)
+	if policy.targetWidth(size) < size.X {
+		return size, nil, false
+	}
+
+	colorProfile, err := readColorProfile(request.InputPath, JPG)
+	if err != nil || (colorProfile != nil && colorProfileNeedsConversion(request.Options, colorProfile)) {
+		return size, nil, false
+	}
+	return size, colorProfile, true
+}
+
+// shrinkJPGLossless writes the jpg at request.InputPath to request.OutputPath with its metadata
+// cleaned up, and its colour profile unless it's sRGB and sRGB was asked for
+func shrinkJPGLossless(request ProcessingRequest, policy *ImagePolicy, size image.Point, colorProfile []byte, ui UI) error {
+	metadata, err := readPhotoMetadata(request.InputPath, size.X, size.Y)
+	if err != nil {
+		ui.Logf("warning: %v", err)
+	}
+	if colorProfile != nil {
+		request.Target.ColorProfile = iccDescription(colorProfile)
+		if request.Options.ColorProfile == SRGBColorProfile {
+			colorProfile = nil // what viewers assume anyway
+		}
+	}
+
+	original, err := ioutil.ReadFile(request.InputPath)
+	if err != nil {
+		return fmt.Errorf("Could not read file %s: %w", request.InputPath, err)
+	}
+
+	optimizer := "go"
+	var optimized bytes.Buffer
+	if toolchain.JPEGTran.Available() {
+		optimizer = "jpegtran"
+		cmd := jpegtranCommand("-copy", "none", "-optimize", "-progressive")
+		err = pipeCommand(cmd, bytes.NewReader(original), &optimized, request.Log, ui)
+		if err != nil {
+			ui.Logf("jpegtran failed, only cleaning up the metadata: %v", err)
+		}
+	}
+	if optimizer == "go" || err != nil {
+		optimizer = "go"
+		optimized.Reset()
+		if err := stripJPEGSegments(original, &optimized); err != nil {
+			return fmt.Errorf("Could not read %s: %w", request.InputPath, err)
+		}
+	}
+
+	out, err := os.Create(request.OutputPath)
+	if err != nil {
+		return fmt.Errorf("Could not create output file %s: %w", request.OutputPath, err)
+	}
+	defer out.Close()
+
+	var writer io.Writer = out
+	segments := append(metadata, iccJPEGSegments(colorProfile)...)
+	if len(segments) > 0 {
+		writer = &jpegSegmentWriter{w: out, segments: segments}
+	}
+	if _, err := writer.Write(optimized.Bytes()); err != nil {
+		return fmt.Errorf("Could not write output file %s: %w", request.OutputPath, err)
+	}
+	request.Target.ImageSettings = fmt.Sprintf("%s %dx%d lossless %s", policy.Name, size.X, size.Y, optimizer)
+	return nil
+}
+
+// stripJPEGSegments copies the jpeg without its application segments and comments, except for the
+// JFIF and Adobe ones that tell how to read the colours. The image data is copied as is.
+func stripJPEGSegments(jpeg []byte, out *bytes.Buffer) error {
+	if len(jpeg) < 4 || jpeg[0] != 0xFF || jpeg[1] != jpegSOI {
+		return fmt.Errorf("not a jpeg file")
+	}
+	out.Write(jpeg[:2])
+	offset := 2
+	for {
+		if offset+4 > len(jpeg) || jpeg[offset] != 0xFF {
+			return fmt.Errorf("invalid jpeg marker at %d", offset)
+		}
+		marker := jpeg[offset+1]
+		if marker == 0xFF { // fill byte
+			offset++
+			continue
+		}
+		if marker == jpegSOS {
+			out.Write(jpeg[offset:])
+			return nil
+		}
+		end := offset + 2 + int(binary.BigEndian.Uint16(jpeg[offset+2:]))
+		if end > len(jpeg) {
+			return fmt.Errorf("jpeg segment truncated")
+		}
+		keep := true
+		switch {
+		case marker == jpegAPP0:
+			keep = bytes.HasPrefix(jpeg[offset+4:end], []byte("JFIF\x00"))
+		case marker == jpegAPP14:
+			keep = bytes.HasPrefix(jpeg[offset+4:end], []byte("Adobe"))
+		case marker > jpegAPP0 && marker <= jpegAPP15, marker == jpegCOM:
+			keep = false
+		}
+		if keep {
+			out.Write(jpeg[offset:end])
+		}
+		offset = end
+	}
+}
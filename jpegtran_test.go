@@ -0,0 +1,121 @@
+package media_shrinker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// testJPEGSegment is a marker segment as it's written in a file
+func testJPEGSegment(marker byte, data string) []byte {
+	segment := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(data)+2))
+	return append(segment, data...)
+}
+
+func TestStripJPEGSegments(t *testing.T) {
+	jfif := testJPEGSegment(jpegAPP0, "JFIF\x00\x01\x02")
+	adobe := testJPEGSegment(jpegAPP14, "Adobe\x00\x64")
+	quantization := testJPEGSegment(0xDB, "\x00\x01\x02\x03")
+	scan := append(testJPEGSegment(jpegSOS, "\x01\x02"), 0x12, 0xFF, 0x00, 0xFF, jpegAPP1, 0x34, 0xFF, jpegEOI)
+
+	var input, want bytes.Buffer
+	input.Write([]byte{0xFF, jpegSOI})
+	want.Write([]byte{0xFF, jpegSOI})
+	for _, segment := range [][]byte{
+		jfif,
+		testJPEGSegment(jpegAPP1, "Exif\x00\x00MM"),
+		testJPEGSegment(jpegAPP0+2, "ICC_PROFILE\x00"),
+		testJPEGSegment(jpegAPP0, "JFXX\x00thumbnail"),
+		adobe,
+		testJPEGSegment(jpegAPP15, "app data"),
+		testJPEGSegment(jpegCOM, "a comment"),
+		quantization,
+	} {
+		input.Write(segment)
+	}
+	input.Write([]byte{0xFF}) // fill byte
+	input.Write(scan)
+	for _, segment := range [][]byte{jfif, adobe, quantization, scan} {
+		want.Write(segment)
+	}
+
+	var out bytes.Buffer
+	if err := stripJPEGSegments(input.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), want.Bytes()) {
+		t.Errorf("got  % x\nwant % x", out.Bytes(), want.Bytes())
+	}
+}
+
+func TestStripJPEGSegmentsInvalid(t *testing.T) {
+	valid := append([]byte{0xFF, jpegSOI}, testJPEGSegment(jpegAPP1, "Exif\x00\x00")...)
+	valid = append(valid, testJPEGSegment(jpegSOS, "\x01")...)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"not a jpeg", []byte("\x89PNG\r\n\x1a\n")},
+		{"garbage after the start", []byte{0xFF, jpegSOI, 0x12, 0x34, 0x56, 0x78}},
+		{"no scan", []byte{0xFF, jpegSOI, 0xFF, jpegAPP0, 0x00, 0x02}},
+		{"segment past the end", []byte{0xFF, jpegSOI, 0xFF, jpegAPP1, 0x10, 0x00, 0x00}},
+	}
+	for length := 0; length < len(valid)-4; length++ {
+		tests = append(tests, struct {
+			name string
+			data []byte
+		}{"truncated", valid[:length]})
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		if err := stripJPEGSegments(test.data, &out); err == nil {
+			t.Errorf("%s (% x): no error", test.name, test.data)
+		}
+	}
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	exifSegment := func(tiff []byte) jpegSegment {
+		return jpegSegment{Marker: jpegAPP1, Data: append(append([]byte{}, exifHeader...), tiff...)}
+	}
+	withOrientation := func(order binary.ByteOrder, orientation uint32) jpegSegment {
+		header := []byte("II*\x00\x08\x00\x00\x00")
+		if order == binary.BigEndian {
+			header = []byte("MM\x00*\x00\x00\x00\x08")
+		}
+		return exifSegment(append(header, testExifIFD(order, []testExifEntry{
+			{tagImageWidth, exifTypeLong, 1, 4000},
+			{tagOrientation, exifTypeShort, 1, orientation},
+		}, 0)...))
+	}
+	camera, _ := testExif(binary.BigEndian)
+
+	tests := []struct {
+		name     string
+		segments []jpegSegment
+		want     int
+	}{
+		{"no segments", nil, exifOrientationNone},
+		{"no EXIF", []jpegSegment{{Marker: jpegAPP1, Data: append([]byte{}, xmpHeader...)}}, exifOrientationNone},
+		{"little endian", []jpegSegment{withOrientation(binary.LittleEndian, 6)}, 6},
+		{"big endian", []jpegSegment{withOrientation(binary.BigEndian, 8)}, 8},
+		{"camera", []jpegSegment{exifSegment(camera)}, 6},
+		{"upright", []jpegSegment{withOrientation(binary.LittleEndian, exifOrientationNone)}, exifOrientationNone},
+		{"no orientation tag", []jpegSegment{exifSegment(append([]byte("II*\x00\x08\x00\x00\x00"), testExifIFD(binary.LittleEndian, nil, 0)...))}, exifOrientationNone},
+		{"short EXIF", []jpegSegment{exifSegment([]byte("II*"))}, exifOrientationNone},
+		{"garbage EXIF", []jpegSegment{exifSegment([]byte("II*\x00\xFF\xFF\x00\x00garbage"))}, exifOrientationNone},
+	}
+	for _, test := range tests {
+		if got := jpegOrientation(test.segments); got != test.want {
+			t.Errorf("%s: orientation %d, want %d", test.name, got, test.want)
+		}
+	}
+
+	// no panics on any truncation
+	for length := 0; length < len(camera); length++ {
+		jpegOrientation([]jpegSegment{exifSegment(camera[:length])})
+	}
+}
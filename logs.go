@@ -0,0 +1,142 @@
+package media_shrinker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Every external command run while processing a media file is written to a log file for that media file:
+// the exact command line followed by everything it printed.
+// Logs are only kept for files that failed.
+
+type FileLog struct {
+	Path string
+
+	mutex sync.Mutex // chunks of a video are encoded in parallel
+	file  *os.File
+}
+
+func OpenFileLog(dir string, name string) (*FileLog, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	logPath := path.Join(dir, name+".log")
+	file, err := os.Create(logPath)
+	if err != nil {
+		return nil, err
+	}
+	return &FileLog{Path: logPath, file: file}, nil
+}
+
+// Command writes the command line about to be run. Does nothing on a nil log, like all the other methods.
+func (l *FileLog) Command(cmd *exec.Cmd) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	fmt.Fprintf(l.file, "\n$ %s\n", cmd.String())
+}
+
+// Output writes text printed by a command. ffmpeg overwrites its progress line using \r, which we turn into line breaks.
+func (l *FileLog) Output(text string) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.file.WriteString(strings.Replace(text, "\r", "\n", -1))
+}
+
+func (l *FileLog) Close() {
+	if l == nil {
+		return
+	}
+	l.file.Close()
+}
+
+// Remove closes and deletes the log; we don't need it when everything went fine
+func (l *FileLog) Remove() {
+	if l == nil {
+		return
+	}
+	l.file.Close()
+	os.Remove(l.Path)
+}
+
+// ffmpeg prints a lot before it fails; the last few lines that are not progress updates are usually the reason
+const errorTailLines = 4
+
+type outputTail struct {
+	lines []string
+}
+
+func (tail *outputTail) Add(text string) {
+	for _, line := range strings.FieldsFunc(text, func(r rune) bool { return r == '\n' || r == '\r' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "frame=") || strings.HasPrefix(line, "size=") {
+			continue
+		}
+		tail.lines = append(tail.lines, line)
+		if len(tail.lines) > errorTailLines {
+			tail.lines = tail.lines[1:]
+		}
+	}
+}
+
+// FFmpegError is returned when ffmpeg (or another external tool) exits with an error
+type FFmpegError struct {
+	Tool    string
+	Err     error
+	Tail    []string // the last lines ffmpeg printed
+	LogPath string   // the full output, if logged
+}
+
+func (e *FFmpegError) Error() string {
+	message := fmt.Sprintf("%s did not close properly? %v", e.Tool, e.Err)
+	if len(e.Tail) > 0 {
+		message += ": " + strings.Join(e.Tail, " | ")
+	}
+	return message
+}
+
+func (e *FFmpegError) Unwrap() error {
+	return e.Err
+}
+
+// A few details of a shrunk file, like its quality score, are kept in the logs directory as
+// "<name>.<kind>", so that later runs (like -report-only) still show them for files shrunk by an
+// earlier one.
+
+func fileRecordPath(logsDir string, mediaFile *MediaFile, kind string) string {
+	return path.Join(logsDir, mediaFile.Name+"."+kind)
+}
+
+// saveFileRecord writes the record of the file, or removes the one of an earlier run if it's empty
+func saveFileRecord(logsDir string, mediaFile *MediaFile, kind string, record string) error {
+	recordPath := fileRecordPath(logsDir, mediaFile, kind)
+	if record == "" {
+		if err := os.Remove(recordPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := os.MkdirAll(logsDir, 0o755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(recordPath, []byte(record+"\n"), 0o644)
+}
+
+// loadFileRecord reads back a record saved by saveFileRecord, or returns an empty one
+func loadFileRecord(logsDir string, mediaFile *MediaFile, kind string) string {
+	record, err := ioutil.ReadFile(fileRecordPath(logsDir, mediaFile, kind))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(record))
+}
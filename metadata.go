@@ -0,0 +1,381 @@
+package media_shrinker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+)
+
+// Metadata of JPEG photos (capture date, camera and lens, GPS, maker notes) is in APP1 segments,
+// as EXIF, and as XMP for the editing apps. The image/jpeg encoder doesn't write any of them,
+// so we copy them from the original into the shrunk file, right after the start of image marker.
+//
+// The pixels are already rotated upright and resized by the time they're encoded, so the
+// orientation is reset and the pixel dimensions updated, in the EXIF and in the XMP. The embedded thumbnail is removed;
+// it still shows the original orientation, and apps make their own anyway.
+
+const (
+	jpegSOI   = 0xD8
+	jpegEOI   = 0xD9
+	jpegSOS   = 0xDA
+	jpegAPP0  = 0xE0
+	jpegAPP1  = 0xE1
+	jpegAPP14 = 0xEE
+	jpegAPP15 = 0xEF
+	jpegCOM   = 0xFE
+)
+
+var (
+	exifHeader        = []byte("Exif\x00\x00")
+	xmpHeader         = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	xmpExtendedHeader = []byte("http://ns.adobe.com/xmp/extension/\x00")
+)
+
+// jpegSegment is a marker segment, without the 0xFF marker prefix and the length
+type jpegSegment struct {
+	Marker byte
+	Data   []byte
+}
+
+// readJPEGSegments reads the marker segments before the image data
+func readJPEGSegments(r io.Reader) ([]jpegSegment, error) {
+	reader := bufio.NewReader(r)
+	var soi [2]byte
+	if _, err := io.ReadFull(reader, soi[:]); err != nil {
+		return nil, err
+	}
+	if soi[0] != 0xFF || soi[1] != jpegSOI {
+		return nil, fmt.Errorf("not a jpeg file")
+	}
+
+	var segments []jpegSegment
+	for {
+		var marker [2]byte
+		if _, err := io.ReadFull(reader, marker[:]); err != nil {
+			return nil, err
+		}
+		if marker[0] != 0xFF {
+			return nil, fmt.Errorf("invalid jpeg marker %x", marker)
+		}
+		if marker[1] == 0xFF { // fill byte
+			reader.UnreadByte()
+			continue
+		}
+		if marker[1] == jpegSOS || marker[1] == jpegEOI {
+			return segments, nil
+		}
+
+		var length [2]byte
+		if _, err := io.ReadFull(reader, length[:]); err != nil {
+			return nil, err
+		}
+		size := int(binary.BigEndian.Uint16(length[:])) - 2
+		if size < 0 {
+			return nil, fmt.Errorf("invalid jpeg segment length")
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		segments = append(segments, jpegSegment{Marker: marker[1], Data: data})
+	}
+}
+
+// readPhotoMetadata returns the EXIF and XMP segments of the JPEG file, ready to be written into the shrunk file
+func readPhotoMetadata(inpath string, width, height int) ([]jpegSegment, error) {
+	file, err := os.Open(inpath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	segments, err := readJPEGSegments(file)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read metadata of %s: %w", inpath, err)
+	}
+
+	var metadata []jpegSegment
+	for _, segment := range segments {
+		if segment.Marker != jpegAPP1 {
+			continue
+		}
+		switch {
+		case bytes.HasPrefix(segment.Data, exifHeader):
+			tiff := segment.Data[len(exifHeader):]
+			tiff, err := updateExif(tiff, width, height)
+			if err != nil {
+				// better no EXIF than EXIF that describes the image wrongly
+				return nil, fmt.Errorf("Could not update EXIF of %s: %w", inpath, err)
+			}
+			segment.Data = append(append([]byte{}, exifHeader...), tiff...)
+		case bytes.HasPrefix(segment.Data, xmpHeader):
+			packet := updateXMP(segment.Data[len(xmpHeader):], width, height)
+			segment.Data = append(append([]byte{}, xmpHeader...), packet...)
+		case bytes.HasPrefix(segment.Data, xmpExtendedHeader):
+		default:
+			continue
+		}
+		metadata = append(metadata, segment)
+	}
+	return metadata, nil
+}
+
+// XMP properties we change, and the values they get; the sizes can only get smaller, so the
+// packet still fits in its segment
+func xmpProperties(width, height int) map[string]int {
+	return map[string]int{
+		"tiff:Orientation":     exifOrientationNone,
+		"tiff:ImageWidth":      width,
+		"tiff:ImageLength":     height,
+		"exif:PixelXDimension": width,
+		"exif:PixelYDimension": height,
+	}
+}
+
+// updateXMP rewrites the orientation and the pixel dimensions in the XMP packet, which has them
+// either as attributes (tiff:Orientation="6") or as elements (<tiff:Orientation>6</tiff:Orientation>)
+func updateXMP(packet []byte, width, height int) []byte {
+	for name, value := range xmpProperties(width, height) {
+		quoted := regexp.QuoteMeta(name)
+		attribute := regexp.MustCompile(`(\b` + quoted + `\s*=\s*["'])[^"']*(["'])`)
+		element := regexp.MustCompile(`(<` + quoted + `>)[^<]*(</` + quoted + `>)`)
+		replacement := []byte("${1}" + strconv.Itoa(value) + "${2}")
+		packet = attribute.ReplaceAll(packet, replacement)
+		packet = element.ReplaceAll(packet, replacement)
+	}
+	return packet
+}
+
+// EXIF tags we change
+const (
+	tagImageWidth       = 0x0100
+	tagImageLength      = 0x0101
+	tagOrientation      = 0x0112
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagInteropIFD       = 0xA005
+	tagPixelXDimension  = 0xA002
+	tagPixelYDimension  = 0xA003
+	tagThumbnailOffset  = 0x0201
+	exifTypeShort       = 3
+	exifTypeLong        = 4
+	exifIFDEntrySize    = 12
+	exifOrientationNone = 1
+)
+
+// Size in bytes of each EXIF value type, by type number
+var exifTypeSizes = []int{0, 1, 1, 2, 4, 8, 1, 1, 2, 4, 8, 4, 8}
+
+// exifData is the TIFF structure inside the EXIF segment; all offsets are from its start
+type exifData struct {
+	data  []byte
+	order binary.ByteOrder
+
+	// end of the furthest value referenced from the main image's IFDs
+	usedEnd int
+}
+
+func newExifData(tiff []byte) (*exifData, error) {
+	if len(tiff) < 8 {
+		return nil, fmt.Errorf("EXIF too short")
+	}
+	exif := &exifData{data: tiff, usedEnd: 8}
+	switch string(tiff[:2]) {
+	case "II":
+		exif.order = binary.LittleEndian
+	case "MM":
+		exif.order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("invalid EXIF byte order")
+	}
+	return exif, nil
+}
+
+// jpegOrientation is the EXIF orientation of the jpeg with these segments; upright if there's none
+func jpegOrientation(segments []jpegSegment) int {
+	for _, segment := range segments {
+		if segment.Marker != jpegAPP1 || !bytes.HasPrefix(segment.Data, exifHeader) {
+			continue
+		}
+		exif, err := newExifData(segment.Data[len(exifHeader):])
+		if err != nil {
+			return exifOrientationNone
+		}
+		orientation := exifOrientationNone
+		exif.walkIFD(int(exif.order.Uint32(exif.data[4:])), func(tag uint16, entry int) error {
+			if tag == tagOrientation {
+				orientation = int(exif.order.Uint16(exif.data[entry+8:]))
+			}
+			return nil
+		})
+		return orientation
+	}
+	return exifOrientationNone
+}
+
+// updateExif edits the TIFF structure of an EXIF segment in place, and drops the thumbnail
+func updateExif(tiff []byte, width, height int) ([]byte, error) {
+	exif, err := newExifData(tiff)
+	if err != nil {
+		return nil, err
+	}
+
+	ifd0 := int(exif.order.Uint32(tiff[4:]))
+	next, err := exif.walkIFD(ifd0, func(tag uint16, entry int) error {
+		switch tag {
+		case tagOrientation:
+			return exif.setInteger(entry, exifOrientationNone)
+		case tagImageWidth:
+			return exif.setInteger(entry, width)
+		case tagImageLength:
+			return exif.setInteger(entry, height)
+		case tagExifIFD, tagGPSIFD:
+			return exif.walkSubIFD(entry, func(tag uint16, entry int) error {
+				switch tag {
+				case tagPixelXDimension:
+					return exif.setInteger(entry, width)
+				case tagPixelYDimension:
+					return exif.setInteger(entry, height)
+				case tagInteropIFD:
+					return exif.walkSubIFD(entry, nil)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if next == 0 {
+		return tiff, nil
+	}
+
+	// IFD1 describes the thumbnail. Unlink it, and if it and the thumbnail are past everything
+	// else (as they usually are), cut them off.
+	usedEnd := exif.usedEnd
+	cut := next
+	thumbnailOffset := 0
+	exif.walkIFD(next, func(tag uint16, entry int) error {
+		if tag == tagThumbnailOffset {
+			thumbnailOffset = int(exif.order.Uint32(tiff[entry+8:]))
+		}
+		return nil
+	})
+	if thumbnailOffset > 0 && thumbnailOffset < cut {
+		cut = thumbnailOffset
+	}
+	exif.order.PutUint32(tiff[exif.nextIFDPointer(ifd0):], 0)
+	if cut >= usedEnd && cut <= len(tiff) {
+		tiff = tiff[:cut]
+	}
+	return tiff, nil
+}
+
+// walkIFD calls fn for every entry of the IFD at offset, with the offset of the entry,
+// and returns the offset of the next IFD
+func (exif *exifData) walkIFD(offset int, fn func(tag uint16, entry int) error) (int, error) {
+	data := exif.data
+	if offset < 8 || offset+2 > len(data) {
+		return 0, fmt.Errorf("invalid IFD offset %d", offset)
+	}
+	count := int(exif.order.Uint16(data[offset:]))
+	end := offset + 2 + count*exifIFDEntrySize + 4
+	if end > len(data) {
+		return 0, fmt.Errorf("IFD at %d is truncated", offset)
+	}
+	exif.markUsed(end)
+
+	for index := 0; index < count; index++ {
+		entry := offset + 2 + index*exifIFDEntrySize
+		valueType := int(exif.order.Uint16(data[entry+2:]))
+		valueCount := int(exif.order.Uint32(data[entry+4:]))
+		if valueType < len(exifTypeSizes) {
+			if size := exifTypeSizes[valueType] * valueCount; size > 4 {
+				exif.markUsed(int(exif.order.Uint32(data[entry+8:])) + size)
+			}
+		}
+		if fn != nil {
+			if err := fn(exif.order.Uint16(data[entry:]), entry); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return int(exif.order.Uint32(data[end-4:])), nil
+}
+
+func (exif *exifData) walkSubIFD(entry int, fn func(tag uint16, entry int) error) error {
+	_, err := exif.walkIFD(int(exif.order.Uint32(exif.data[entry+8:])), fn)
+	return err
+}
+
+func (exif *exifData) nextIFDPointer(offset int) int {
+	count := int(exif.order.Uint16(exif.data[offset:]))
+	return offset + 2 + count*exifIFDEntrySize
+}
+
+func (exif *exifData) markUsed(end int) {
+	if end > exif.usedEnd {
+		exif.usedEnd = end
+	}
+}
+
+// setInteger changes the value of a SHORT or LONG entry; such values are always stored in the entry itself
+func (exif *exifData) setInteger(entry int, value int) error {
+	value32 := make([]byte, 4)
+	switch exif.order.Uint16(exif.data[entry+2:]) {
+	case exifTypeShort:
+		exif.order.PutUint16(value32, uint16(value))
+	case exifTypeLong:
+		exif.order.PutUint32(value32, uint32(value))
+	default:
+		return fmt.Errorf("unexpected type of EXIF tag %#04x", exif.order.Uint16(exif.data[entry:]))
+	}
+	copy(exif.data[entry+8:], value32)
+	return nil
+}
+
+// jpegSegmentWriter writes the segments right after the start of image marker of the jpeg written through it
+type jpegSegmentWriter struct {
+	w        io.Writer
+	segments []jpegSegment
+	header   []byte // the start of the output, until the start of image marker went through
+}
+
+func (sw *jpegSegmentWriter) Write(p []byte) (int, error) {
+	if sw.segments == nil {
+		return sw.w.Write(p)
+	}
+
+	written := 0
+	for len(sw.header) < 2 && len(p) > 0 {
+		sw.header = append(sw.header, p[0])
+		p = p[1:]
+		written++
+	}
+	if len(sw.header) < 2 {
+		return written, nil
+	}
+
+	var buffer bytes.Buffer
+	buffer.Write(sw.header)
+	for _, segment := range sw.segments {
+		if len(segment.Data)+2 > 0xFFFF {
+			continue // can't be written as a single segment; it didn't come from a valid file
+		}
+		buffer.Write([]byte{0xFF, segment.Marker})
+		binary.Write(&buffer, binary.BigEndian, uint16(len(segment.Data)+2))
+		buffer.Write(segment.Data)
+	}
+	sw.segments = nil
+	if _, err := sw.w.Write(buffer.Bytes()); err != nil {
+		return written, err
+	}
+	n, err := sw.w.Write(p)
+	return written + n, err
+}
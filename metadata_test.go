@@ -0,0 +1,298 @@
+package media_shrinker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+)
+
+type testExifEntry struct {
+	tag, valueType uint16
+	count, value   uint32
+}
+
+// testExifIFD writes an IFD with its entries and the offset of the next IFD
+func testExifIFD(order binary.ByteOrder, entries []testExifEntry, next uint32) []byte {
+	ifd := make([]byte, 2+len(entries)*exifIFDEntrySize+4)
+	order.PutUint16(ifd, uint16(len(entries)))
+	for index, entry := range entries {
+		field := ifd[2+index*exifIFDEntrySize:]
+		order.PutUint16(field, entry.tag)
+		order.PutUint16(field[2:], entry.valueType)
+		order.PutUint32(field[4:], entry.count)
+		if entry.valueType == exifTypeShort && entry.count == 1 {
+			order.PutUint16(field[8:], uint16(entry.value))
+		} else {
+			order.PutUint32(field[8:], entry.value)
+		}
+	}
+	order.PutUint32(ifd[len(ifd)-4:], next)
+	return ifd
+}
+
+func testIFDSize(entries int) int {
+	return 2 + entries*exifIFDEntrySize + 4
+}
+
+// testExif builds the TIFF structure of a camera photo: IFD0 with the orientation and the size,
+// the EXIF IFD with the pixel dimensions, and IFD1 with a thumbnail at the end. It returns the
+// offset of IFD1 too.
+func testExif(order binary.ByteOrder) ([]byte, int) {
+	const orientationRotate90 = 6
+	exifIFD := 8 + testIFDSize(4)
+	ifd1 := exifIFD + testIFDSize(2)
+	thumbnail := ifd1 + testIFDSize(2)
+
+	var tiff bytes.Buffer
+	if order == binary.LittleEndian {
+		tiff.WriteString("II")
+	} else {
+		tiff.WriteString("MM")
+	}
+	header := make([]byte, 6)
+	order.PutUint16(header, 42)
+	order.PutUint32(header[2:], 8)
+	tiff.Write(header)
+	tiff.Write(testExifIFD(order, []testExifEntry{
+		{tagImageWidth, exifTypeLong, 1, 4000},
+		{tagImageLength, exifTypeShort, 1, 3000},
+		{tagOrientation, exifTypeShort, 1, orientationRotate90},
+		{tagExifIFD, exifTypeLong, 1, uint32(exifIFD)},
+	}, uint32(ifd1)))
+	tiff.Write(testExifIFD(order, []testExifEntry{
+		{tagPixelXDimension, exifTypeLong, 1, 4000},
+		{tagPixelYDimension, exifTypeShort, 1, 3000},
+	}, 0))
+	tiff.Write(testExifIFD(order, []testExifEntry{
+		{tagThumbnailOffset, exifTypeLong, 1, uint32(thumbnail)},
+		{tagThumbnailOffset + 1, exifTypeLong, 1, 16},
+	}, 0))
+	tiff.Write(bytes.Repeat([]byte{0xAB}, 16))
+	return tiff.Bytes(), ifd1
+}
+
+// testExifTags reads the integer tags of the IFD at offset, and returns the offset of the next IFD
+func testExifTags(t *testing.T, order binary.ByteOrder, tiff []byte, offset int) (map[uint16]int, int) {
+	t.Helper()
+	if offset+2 > len(tiff) {
+		t.Fatalf("IFD at %d is past the end (%d bytes)", offset, len(tiff))
+	}
+	tags := make(map[uint16]int)
+	count := int(order.Uint16(tiff[offset:]))
+	for index := 0; index < count; index++ {
+		field := tiff[offset+2+index*exifIFDEntrySize:]
+		if order.Uint16(field[2:]) == exifTypeShort {
+			tags[order.Uint16(field)] = int(order.Uint16(field[8:]))
+		} else {
+			tags[order.Uint16(field)] = int(order.Uint32(field[8:]))
+		}
+	}
+	return tags, int(order.Uint32(tiff[offset+2+count*exifIFDEntrySize:]))
+}
+
+func TestUpdateExif(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		tiff, ifd1 := testExif(order)
+		updated, err := updateExif(tiff, 800, 600)
+		if err != nil {
+			t.Fatalf("%v: %v", order, err)
+		}
+
+		ifd0, next := testExifTags(t, order, updated, 8)
+		if ifd0[tagOrientation] != exifOrientationNone {
+			t.Errorf("%v: orientation is %d, want %d", order, ifd0[tagOrientation], exifOrientationNone)
+		}
+		if ifd0[tagImageWidth] != 800 || ifd0[tagImageLength] != 600 {
+			t.Errorf("%v: image size is %dx%d, want 800x600", order, ifd0[tagImageWidth], ifd0[tagImageLength])
+		}
+		exifIFD, _ := testExifTags(t, order, updated, ifd0[tagExifIFD])
+		if exifIFD[tagPixelXDimension] != 800 || exifIFD[tagPixelYDimension] != 600 {
+			t.Errorf("%v: pixel dimensions are %dx%d, want 800x600", order, exifIFD[tagPixelXDimension], exifIFD[tagPixelYDimension])
+		}
+		if next != 0 {
+			t.Errorf("%v: IFD0 still links to IFD1 at %d", order, next)
+		}
+		if len(updated) != ifd1 {
+			t.Errorf("%v: EXIF is %d bytes, want %d without the thumbnail", order, len(updated), ifd1)
+		}
+	}
+}
+
+func TestUpdateExifKeepsValuesAfterThumbnail(t *testing.T) {
+	order := binary.BigEndian
+	tiff, _ := testExif(order)
+	// a maker note stored after the thumbnail, which cutting it off would lose
+	makerNote := len(tiff)
+	tiff = append(tiff, bytes.Repeat([]byte{0xCD}, 8)...)
+	entries := []testExifEntry{
+		{tagImageWidth, exifTypeLong, 1, 4000},
+		{tagImageLength, exifTypeShort, 1, 3000},
+		{tagOrientation, exifTypeShort, 1, 6},
+		{0x927C, 7, 8, uint32(makerNote)},
+	}
+	copy(tiff[8:], testExifIFD(order, entries, order.Uint32(tiff[8+2+4*exifIFDEntrySize:])))
+
+	updated, err := updateExif(tiff, 800, 600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, next := testExifTags(t, order, updated, 8); next != 0 {
+		t.Errorf("IFD0 still links to IFD1 at %d", next)
+	}
+	if len(updated) != len(tiff) {
+		t.Errorf("EXIF was cut to %d bytes, but the maker note ends at %d", len(updated), len(tiff))
+	}
+}
+
+func TestUpdateExifWithoutThumbnail(t *testing.T) {
+	order := binary.LittleEndian
+	tiff := append([]byte("II*\x00\x08\x00\x00\x00"), testExifIFD(order, []testExifEntry{
+		{tagOrientation, exifTypeShort, 1, 8},
+	}, 0)...)
+	updated, err := updateExif(tiff, 800, 600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags, _ := testExifTags(t, order, updated, 8); tags[tagOrientation] != exifOrientationNone {
+		t.Errorf("orientation is %d, want %d", tags[tagOrientation], exifOrientationNone)
+	}
+	if len(updated) != len(tiff) {
+		t.Errorf("EXIF is %d bytes, want %d", len(updated), len(tiff))
+	}
+}
+
+func TestUpdateExifInvalid(t *testing.T) {
+	order := binary.LittleEndian
+	rationalOrientation := append([]byte("II*\x00\x08\x00\x00\x00"), testExifIFD(order, []testExifEntry{
+		{tagOrientation, 5, 1, 40},
+	}, 0)...)
+	badExifIFD := append([]byte("II*\x00\x08\x00\x00\x00"), testExifIFD(order, []testExifEntry{
+		{tagExifIFD, exifTypeLong, 1, 0xFFFFFF},
+	}, 0)...)
+
+	tests := []struct {
+		name string
+		tiff []byte
+	}{
+		{"empty", nil},
+		{"short", []byte("II*\x00")},
+		{"byte order", []byte("XX*\x00\x08\x00\x00\x00\x00\x00\x00\x00\x00\x00")},
+		{"IFD0 offset past the end", []byte("MM\x00*\x00\x00\xFF\xFF")},
+		{"IFD0 offset in the header", []byte("II*\x00\x02\x00\x00\x00\x00\x00\x00\x00\x00\x00")},
+		{"IFD0 truncated", []byte("II*\x00\x08\x00\x00\x00\x05\x00\x00\x00")},
+		{"orientation as a rational", rationalOrientation},
+		{"EXIF IFD past the end", badExifIFD},
+	}
+	for _, test := range tests {
+		if _, err := updateExif(append([]byte{}, test.tiff...), 800, 600); err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+}
+
+func TestUpdateExifTruncated(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		tiff, ifd1 := testExif(order)
+		exifIFDEnd := ifd1
+		for length := 0; length < len(tiff); length++ {
+			truncated := append([]byte{}, tiff[:length]...)
+			_, err := updateExif(truncated, 800, 600)
+			if length < exifIFDEnd && err == nil {
+				t.Errorf("%v: no error with only %d of %d bytes", order, length, len(tiff))
+			}
+		}
+	}
+}
+
+func TestUpdateXMP(t *testing.T) {
+	tests := []struct {
+		name, packet, want string
+	}{
+		{
+			"attributes",
+			`<rdf:Description tiff:Orientation="6" tiff:ImageWidth="4000" tiff:ImageLength='3000' exif:PixelXDimension = "4000" exif:PixelYDimension="3000"/>`,
+			`<rdf:Description tiff:Orientation="1" tiff:ImageWidth="800" tiff:ImageLength='600' exif:PixelXDimension = "800" exif:PixelYDimension="600"/>`,
+		},
+		{
+			"elements",
+			`<tiff:Orientation>8</tiff:Orientation><exif:PixelXDimension>4000</exif:PixelXDimension><exif:PixelYDimension>3000</exif:PixelYDimension>`,
+			`<tiff:Orientation>1</tiff:Orientation><exif:PixelXDimension>800</exif:PixelXDimension><exif:PixelYDimension>600</exif:PixelYDimension>`,
+		},
+		{
+			"other properties",
+			`<rdf:Description xmp:Rating="5" tiff:ImageWidthX="4000" crs:Orientation="6"><dc:title>tiff:Orientation</dc:title></rdf:Description>`,
+			`<rdf:Description xmp:Rating="5" tiff:ImageWidthX="4000" crs:Orientation="6"><dc:title>tiff:Orientation</dc:title></rdf:Description>`,
+		},
+	}
+	for _, test := range tests {
+		if got := string(updateXMP([]byte(test.packet), 800, 600)); got != test.want {
+			t.Errorf("%s:\ngot  %s\nwant %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestJPEGSegmentWriter(t *testing.T) {
+	jpegData := []byte{0xFF, jpegSOI, 0xFF, jpegAPP0, 0x00, 0x04, 'J', 'F', 0xFF, jpegEOI}
+	segments := []jpegSegment{
+		{Marker: jpegAPP1, Data: []byte("Exif\x00\x00II")},
+		{Marker: jpegAPP1, Data: make([]byte, 0xFFFF)}, // too big for a segment
+	}
+	want := []byte{0xFF, jpegSOI, 0xFF, jpegAPP1, 0x00, 0x0A}
+	want = append(want, "Exif\x00\x00II"...)
+	want = append(want, jpegData[2:]...)
+
+	// written a byte at a time, so the start of image marker is split between writes
+	var out bytes.Buffer
+	writer := &jpegSegmentWriter{w: &out, segments: segments}
+	for index := range jpegData {
+		n, err := writer.Write(jpegData[index : index+1])
+		if n != 1 || err != nil {
+			t.Fatalf("Write returned %d, %v", n, err)
+		}
+	}
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("got % x\nwant % x", out.Bytes(), want)
+	}
+}
+
+func TestReadPhotoMetadata(t *testing.T) {
+	tiff, ifd1 := testExif(binary.BigEndian)
+	xmp := `<x:xmpmeta><rdf:Description tiff:Orientation="6" exif:PixelXDimension="4000"/></x:xmpmeta>`
+	segments := []jpegSegment{
+		{Marker: jpegAPP1, Data: append(append([]byte{}, exifHeader...), tiff...)},
+		{Marker: jpegAPP1, Data: append(append([]byte{}, xmpHeader...), xmp...)},
+		{Marker: jpegAPP0 + 13, Data: []byte("Photoshop 3.0\x00")},
+	}
+	var photo bytes.Buffer
+	if err := jpeg.Encode(&jpegSegmentWriter{w: &photo, segments: segments}, image.NewGray(image.Rect(0, 0, 16, 16)), nil); err != nil {
+		t.Fatal(err)
+	}
+	photoPath := path.Join(t.TempDir(), "photo.jpg")
+	if err := ioutil.WriteFile(photoPath, photo.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	metadata, err := readPhotoMetadata(photoPath, 800, 600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metadata) != 2 {
+		t.Fatalf("got %d segments, want the EXIF and the XMP", len(metadata))
+	}
+	exif := metadata[0].Data[len(exifHeader):]
+	if tags, _ := testExifTags(t, binary.BigEndian, exif, 8); tags[tagOrientation] != exifOrientationNone {
+		t.Errorf("EXIF orientation is %d, want %d", tags[tagOrientation], exifOrientationNone)
+	}
+	if len(exif) != ifd1 {
+		t.Errorf("EXIF is %d bytes, want %d without the thumbnail", len(exif), ifd1)
+	}
+	packet := string(metadata[1].Data[len(xmpHeader):])
+	if !strings.Contains(packet, `tiff:Orientation="1"`) || !strings.Contains(packet, `exif:PixelXDimension="800"`) {
+		t.Errorf("XMP not updated: %s", packet)
+	}
+}
@@ -0,0 +1,271 @@
+package media_shrinker
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"sort"
+)
+
+// Palette quantization for png: screenshots and diagrams have few distinct colours, and as 8-bit
+// paletted images they take a fraction of the space. Images that already fit in the palette are
+// converted exactly; the others get a median cut palette and Floyd-Steinberg dithering, and are
+// only kept paletted if every channel, alpha included, keeps the SSIM floor of the policy.
+
+const defaultPaletteSSIM = 0.98
+
+type colorCount struct {
+	c [4]uint8 // non-premultiplied RGBA
+	n int
+}
+
+// quantizePalette converts the image to at most policy.PaletteColors colours. It returns nil if
+// the result would lose too much, and otherwise the paletted image and its score (1 if lossless).
+func quantizePalette(img image.Image, policy *ImagePolicy) (*image.Paletted, float64) {
+	bounds := img.Bounds()
+	src := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+
+	counts := make(map[[4]uint8]int)
+	for i := 0; i < len(src.Pix); i += 4 {
+		counts[pixelAt(src.Pix, i)]++
+	}
+	entries := make([]colorCount, 0, len(counts))
+	for c, n := range counts {
+		entries = append(entries, colorCount{c, n})
+	}
+	// in a fixed order, so the same image always gives the same palette
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i].c, entries[j].c
+		for channel := range a {
+			if a[channel] != b[channel] {
+				return a[channel] < b[channel]
+			}
+		}
+		return false
+	})
+
+	dst := image.NewPaletted(src.Rect, nil)
+	if len(entries) <= policy.PaletteColors {
+		index := make(map[[4]uint8]uint8, len(entries))
+		for i, entry := range entries {
+			index[entry.c] = uint8(i)
+			dst.Palette = append(dst.Palette, nrgba(entry.c))
+		}
+		for i := range dst.Pix {
+			dst.Pix[i] = index[pixelAt(src.Pix, i*4)]
+		}
+		return dst, 1
+	}
+
+	dst.Palette = medianCut(entries, policy.PaletteColors)
+	ditherPalette(src, dst)
+
+	floor := policy.TargetSSIM
+	if floor == 0 {
+		floor = defaultPaletteSSIM
+	}
+	score := 1.0
+	channels := 3
+	if hasAlpha(img) {
+		channels = 4
+	}
+	quantized := image.NewNRGBA(src.Rect)
+	draw.Draw(quantized, quantized.Rect, dst, image.Point{}, draw.Src)
+	for channel := 0; channel < channels; channel++ {
+		score = math.Min(score, ssim(channelPlane(src, channel), channelPlane(quantized, channel)))
+	}
+	if score < floor {
+		return nil, score
+	}
+	return dst, score
+}
+
+// pixelAt reads the pixel at offset i of NRGBA pixels; fully transparent pixels are all the same
+func pixelAt(pix []uint8, i int) [4]uint8 {
+	if pix[i+3] == 0 {
+		return [4]uint8{}
+	}
+	return [4]uint8{pix[i], pix[i+1], pix[i+2], pix[i+3]}
+}
+
+func nrgba(c [4]uint8) color.NRGBA {
+	return color.NRGBA{c[0], c[1], c[2], c[3]}
+}
+
+// channelPlane is one channel of the image, where the colour of transparent pixels doesn't count
+func channelPlane(img *image.NRGBA, channel int) plane {
+	p := plane{width: img.Rect.Dx(), height: img.Rect.Dy()}
+	p.pixels = make([]float64, len(img.Pix)/4)
+	for i := range p.pixels {
+		p.pixels[i] = float64(pixelAt(img.Pix, i*4)[channel])
+	}
+	return p
+}
+
+type colorBox struct {
+	entries []colorCount
+	channel int     // the channel with the most spread, to split along
+	spread  float64 // the squared error along that channel, weighted by pixel count
+}
+
+func newColorBox(entries []colorCount) colorBox {
+	box := colorBox{entries: entries}
+	var total float64
+	var sums [4]float64
+	for _, entry := range entries {
+		for channel := range sums {
+			sums[channel] += float64(entry.c[channel]) * float64(entry.n)
+		}
+		total += float64(entry.n)
+	}
+	for channel := range sums {
+		mean := sums[channel] / total
+		var spread float64
+		for _, entry := range entries {
+			diff := float64(entry.c[channel]) - mean
+			spread += diff * diff * float64(entry.n)
+		}
+		if spread > box.spread {
+			box.channel, box.spread = channel, spread
+		}
+	}
+	return box
+}
+
+// medianCut splits the colours into boxes until there are as many as the palette can hold,
+// always splitting the box with the largest error at its weighted median
+func medianCut(entries []colorCount, colors int) color.Palette {
+	var palette color.Palette
+	var opaque []colorCount
+	for _, entry := range entries {
+		if entry.c[3] == 0 {
+			// transparent pixels get their own entry, so they stay transparent
+			palette = append(palette, color.NRGBA{})
+			colors--
+		} else {
+			opaque = append(opaque, entry)
+		}
+	}
+
+	boxes := []colorBox{newColorBox(opaque)}
+	for len(boxes) < colors {
+		largest := 0
+		for i, box := range boxes {
+			if box.spread > boxes[largest].spread {
+				largest = i
+			}
+		}
+		box := boxes[largest]
+		if box.spread == 0 {
+			break
+		}
+
+		sort.SliceStable(box.entries, func(i, j int) bool {
+			return box.entries[i].c[box.channel] < box.entries[j].c[box.channel]
+		})
+		var total, half int
+		for _, entry := range box.entries {
+			total += entry.n
+		}
+		split := 1
+		for i, entry := range box.entries[:len(box.entries)-1] {
+			half += entry.n
+			split = i + 1
+			if half*2 >= total {
+				break
+			}
+		}
+		boxes[largest] = newColorBox(box.entries[:split])
+		boxes = append(boxes, newColorBox(box.entries[split:]))
+	}
+
+	for _, box := range boxes {
+		var sums [4]float64
+		var total float64
+		for _, entry := range box.entries {
+			for channel := range sums {
+				sums[channel] += float64(entry.c[channel]) * float64(entry.n)
+			}
+			total += float64(entry.n)
+		}
+		var c [4]uint8
+		for channel := range c {
+			c[channel] = uint8(sums[channel]/total + 0.5)
+		}
+		palette = append(palette, nrgba(c))
+	}
+	return palette
+}
+
+// ditherPalette maps every pixel to the nearest colour of the palette, spreading the difference
+// to the neighbouring pixels (Floyd-Steinberg). Fully transparent pixels neither take nor give any.
+func ditherPalette(src *image.NRGBA, dst *image.Paletted) {
+	width, height := src.Rect.Dx(), src.Rect.Dy()
+	colors := make([][4]float64, len(dst.Palette))
+	transparent := -1
+	for i, c := range dst.Palette {
+		entry := c.(color.NRGBA)
+		colors[i] = [4]float64{float64(entry.R), float64(entry.G), float64(entry.B), float64(entry.A)}
+		if entry.A == 0 {
+			transparent = i
+		}
+	}
+
+	// the search is cached by the top 6 bits of each channel; close colours share their nearest entry
+	cache := make(map[uint32]uint8)
+	nearest := func(c [4]float64) uint8 {
+		var key uint32
+		for _, v := range c {
+			key = key<<6 | uint32(v)>>2
+		}
+		if index, ok := cache[key]; ok {
+			return index
+		}
+		best, bestDistance := 0, -1.0
+		for i, entry := range colors {
+			if i == transparent {
+				continue
+			}
+			var distance float64
+			for channel := range entry {
+				diff := entry[channel] - c[channel]
+				distance += diff * diff
+			}
+			if bestDistance < 0 || distance < bestDistance {
+				best, bestDistance = i, distance
+			}
+		}
+		cache[key] = uint8(best)
+		return uint8(best)
+	}
+
+	current, next := make([][4]float64, width+2), make([][4]float64, width+2)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			offset := y*src.Stride + x*4
+			if src.Pix[offset+3] == 0 && transparent >= 0 {
+				dst.Pix[y*dst.Stride+x] = uint8(transparent)
+				continue
+			}
+			var c [4]float64
+			for channel := range c {
+				c[channel] = math.Max(0, math.Min(255, float64(src.Pix[offset+channel])+current[x+1][channel]))
+			}
+			index := nearest(c)
+			dst.Pix[y*dst.Stride+x] = index
+			for channel := range c {
+				diff := c[channel] - colors[index][channel]
+				current[x+2][channel] += diff * 7 / 16
+				next[x][channel] += diff * 3 / 16
+				next[x+1][channel] += diff * 5 / 16
+				next[x+2][channel] += diff * 1 / 16
+			}
+		}
+		current, next = next, current
+		for i := range next {
+			next[i] = [4]float64{}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package media_shrinker
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+func TestQuantizePaletteExact(t *testing.T) {
+	for _, n := range []int{2, 16, 255} {
+		img := testPaletteImage(n)
+		// fully transparent pixels, whatever their colour, become one more entry
+		img.SetNRGBA(0, 0, color.NRGBA{200, 100, 50, 0})
+		img.SetNRGBA(1, 0, color.NRGBA{10, 20, 30, 0})
+		colors := n + 1
+
+		policy := DefaultGraphicPolicy
+		policy.PaletteColors = colors
+		paletted, score := quantizePalette(img, &policy)
+		if paletted == nil {
+			t.Fatalf("%d colours: not quantized, score %f", n, score)
+		}
+		if score != 1 || len(paletted.Palette) != colors {
+			t.Errorf("%d colours: score %f with a palette of %d, want 1 with %d", n, score, len(paletted.Palette), colors)
+		}
+		for y := 0; y < 16; y++ {
+			for x := 0; x < 17; x++ {
+				want := img.NRGBAAt(x, y)
+				if want.A == 0 {
+					want = color.NRGBA{}
+				}
+				if got := color.NRGBAModel.Convert(paletted.At(x, y)); got != want {
+					t.Errorf("%d colours: pixel %d,%d is %v, want %v", n, x, y, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestQuantizePaletteDithered(t *testing.T) {
+	// a smooth gradient, with a transparent hole
+	img := testGradientImage(func(x, y int) color.NRGBA {
+		if x >= 5 && x < 8 && y >= 5 && y < 8 {
+			return color.NRGBA{}
+		}
+		return color.NRGBA{uint8(x * 12), uint8(y * 13), 128, 255}
+	})
+	policy := DefaultGraphicPolicy
+	policy.PaletteColors = 64
+	policy.TargetSSIM = 0.5
+	paletted, score := quantizePalette(img, &policy)
+	if paletted == nil {
+		t.Fatalf("not quantized, score %f", score)
+	}
+	if len(paletted.Palette) > policy.PaletteColors {
+		t.Errorf("palette of %d colours, want at most %d", len(paletted.Palette), policy.PaletteColors)
+	}
+	if score >= 1 || score < policy.TargetSSIM {
+		t.Errorf("score %f, want between %f and 1", score, policy.TargetSSIM)
+	}
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			transparent := img.NRGBAAt(x, y).A == 0
+			if _, _, _, a := paletted.At(x, y).RGBA(); (a == 0) != transparent {
+				t.Errorf("pixel %d,%d has alpha %d, but was transparent: %v", x, y, a, transparent)
+			}
+		}
+	}
+
+	// the same image always gives the same palette
+	again, _ := quantizePalette(img, &policy)
+	for index := range paletted.Palette {
+		if again.Palette[index] != paletted.Palette[index] {
+			t.Fatalf("the palette changed between runs")
+		}
+	}
+}
+
+func TestQuantizePaletteFloor(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	img := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	random.Read(img.Pix)
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 255
+	}
+	policy := DefaultGraphicPolicy
+	policy.PaletteColors = 2
+	if paletted, score := quantizePalette(img, &policy); paletted != nil {
+		t.Errorf("noise quantized to 2 colours with score %f", score)
+	}
+}
+
+func TestMedianCut(t *testing.T) {
+	entries := []colorCount{
+		{[4]uint8{0, 0, 0, 0}, 10},
+		{[4]uint8{255, 0, 0, 255}, 5},
+		{[4]uint8{250, 0, 0, 255}, 5},
+		{[4]uint8{0, 0, 255, 255}, 5},
+		{[4]uint8{0, 0, 250, 255}, 5},
+	}
+	palette := medianCut(entries, 3)
+	if len(palette) != 3 {
+		t.Fatalf("palette of %d colours, want 3", len(palette))
+	}
+	want := map[color.NRGBA]bool{
+		{}:               true, // transparent
+		{253, 0, 0, 255}: true, // mean of the reds
+		{0, 0, 253, 255}: true, // mean of the blues
+	}
+	for _, c := range palette {
+		if !want[c.(color.NRGBA)] {
+			t.Errorf("unexpected colour %v in %v", c, palette)
+		}
+	}
+
+	// no more colours than the image has, when it has fewer than asked
+	if palette := medianCut(entries[1:2], 8); len(palette) != 1 {
+		t.Errorf("palette of %d colours for one colour", len(palette))
+	}
+}
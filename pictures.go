@@ -1,6 +1,8 @@
 package media_shrinker
 
 import "os"
+import "path"
+import "bytes"
 import "io"
 import "image"
 import "image/png"
@@ -9,36 +11,79 @@ import "github.com/disintegration/imageorient"
 import "github.com/nfnt/resize"
 import "fmt"
 
-func ResizeImage(img image.Image) image.Image {
-	size := img.Bounds().Size()
-	desiredWidth := 2048
-	if size.Y > size.X { // vertical image
-		desiredWidth = 1080
-	}
-	if size.X < desiredWidth {
-		desiredWidth = size.X // no scale up
-	}
+func ResizeImage(img image.Image, policy *ImagePolicy) image.Image {
+	desiredWidth := policy.targetWidth(img.Bounds().Size())
+	return resize.Resize(uint(desiredWidth), 0, img, policy.resampleFilter())
+}
 
-	return resize.Resize(uint(desiredWidth), 0, img, resize.Lanczos3)
+// imageEncoding records how an image was encoded
+type imageEncoding struct {
+	Encoder     string  // "go" for the built-in encoders (with the layout of optimized png), or the external tool
+	Subsampling string  // chroma subsampling, for jpeg
+	Unverified  bool    // the output could not be decoded back, for avif
+	Colors      int     // size of the palette, for quantized png
+	SSIM        float64 // score against the unquantized image, for quantized png
 }
 
-type EncoderFn func(out io.Writer, img image.Image) error
+type EncoderFn func(out io.Writer, img image.Image, policy *ImagePolicy, ui UI) (imageEncoding, error)
 
-func encodePng(out io.Writer, img image.Image) error {
+func encodePng(out io.Writer, img image.Image, policy *ImagePolicy, ui UI) (imageEncoding, error) {
 	encoder := png.Encoder {
-		CompressionLevel: png.BestCompression,
+		CompressionLevel: policy.pngCompressionLevel(),
+	}
+	encoding := imageEncoding{Encoder: "go"}
+	if policy.PaletteColors > 0 {
+		paletted, score := quantizePalette(img, policy)
+		if paletted != nil {
+			img = paletted
+			encoding.Colors, encoding.SSIM = len(paletted.Palette), score
+		} else {
+			ui.Logf("keeping all colours; a palette of %d scored SSIM %.4f", policy.PaletteColors, score)
+		}
+	}
+	if !policy.OptimizePNG {
+		return encoding, encoder.Encode(out, img)
+	}
+
+	var baseline bytes.Buffer
+	if err := encoder.Encode(&baseline, img); err != nil {
+		return encoding, err
+	}
+	encoded := baseline.Bytes()
+	optimized, layout, err := optimizePNG(img, encoded, policy)
+	if err != nil {
+		ui.Logf("warning: could not optimize png: %v", err)
+	} else if optimized != nil {
+		encoded = optimized
+		encoding.Encoder = "go " + layout
 	}
-	return encoder.Encode(out, img)
+	_, err = out.Write(encoded)
+	return encoding, err
 }
 
-func encodeJpeg(out io.Writer, img image.Image) error {
+// encodeJpeg uses cjpeg when it's configured, and the built-in encoder otherwise, or if cjpeg fails
+func encodeJpeg(out io.Writer, img image.Image, policy *ImagePolicy, ui UI) (imageEncoding, error) {
+	if toolchain.CJpeg.Available() {
+		encoding, err := encodeCJpeg(out, img, policy, ui)
+		if err == nil {
+			return encoding, nil
+		}
+		ui.Logf("cjpeg failed, using the built-in encoder: %v", err)
+	}
+
+	// The image/jpeg encoder always subsamples chroma to 4:2:0
 	options := jpeg.Options {
-		Quality: 90,
+		Quality: policy.Quality,
 	}
-	return jpeg.Encode(out, img, &options)
+	return imageEncoding{Encoder: "go", Subsampling: "420"}, jpeg.Encode(out, img, &options)
 }
 
 func ShrinkImage(request ProcessingRequest, encoder EncoderFn, ui UI) error {
+	// photos that are small enough already keep their pixels as they are, and aren't even decoded
+	if size, colorProfile, ok := losslessJPEG(request, &request.Options.PhotoPolicy); ok {
+		return shrinkJPGLossless(request, &request.Options.PhotoPolicy, size, colorProfile, ui)
+	}
+
 	file, err := os.Open(request.InputPath)
 	if err != nil {
 		return fmt.Errorf("Could not open file %s: %w", request.InputPath, err)
@@ -50,7 +95,59 @@ func ShrinkImage(request ProcessingRequest, encoder EncoderFn, ui UI) error {
 		return fmt.Errorf("Could not decode file %s: %w", request.InputPath, err)
 	}
 
-	imgResized := ResizeImage(img)
+	policy := imagePolicyFor(request.Options, request.Target)
+	format := imageFormat(request.Options, request.Target)
+	outputType := request.Target.Type
+
+	// photos saved as png are shrunk like any other photo
+	if name := photoOutputName(request.Options, request.Target); name != "" && isPhotographic(img) {
+		policy = &request.Options.PhotoPolicy
+		format = policyFormat(policy)
+		outputType = JPG
+		encoder = encodeJpeg
+		request.OutputPath = replaceExt(request.OutputPath, path.Ext(name))
+		request.Target.OutputName = name
+	}
+	imgResized := ResizeImage(img, policy)
+
+	// keep the capture date, camera, location, etc. of photos
+	var metadata []jpegSegment
+	if request.Target.Type == JPG {
+		size := imgResized.Bounds().Size()
+		metadata, err = readPhotoMetadata(request.InputPath, size.X, size.Y)
+		if err != nil {
+			ui.Logf("warning: %v", err)
+		}
+	}
+
+	colorProfile, err := readColorProfile(request.InputPath, request.Target.Type)
+	if err != nil {
+		ui.Logf("warning: %v", err)
+	}
+	if colorProfile != nil {
+		imgResized, colorProfile = applyColorProfile(request, imgResized, colorProfile, ui)
+	}
+
+	if format == AVIFFormat && !avifKeepsImage(imgResized) {
+		ui.Logf("%s is transparent, which only avifenc can keep in avif; keeping it as %s", request.Target.Name, request.Target.Type)
+		format = ""
+		request.OutputPath = replaceExt(request.OutputPath, path.Ext(request.Target.Name))
+		request.Target.OutputName = request.Target.Name
+	}
+	switch format {
+	case WebPFormat, AVIFFormat:
+		var encoding imageEncoding
+		if format == WebPFormat {
+			encoding, err = encodeWebP(request, imgResized, policy, metadata, colorProfile, ui)
+		} else {
+			encoding, err = encodeAVIF(request, imgResized, policy, metadata, colorProfile, ui)
+		}
+		if err != nil {
+			return err
+		}
+		request.Target.ImageSettings = policy.describe(format, imgResized.Bounds().Size(), encoding)
+		return nil
+	}
 
 	out, err := os.Create(request.OutputPath)
 	if err != nil {
@@ -58,7 +155,42 @@ func ShrinkImage(request ProcessingRequest, encoder EncoderFn, ui UI) error {
 	}
 	defer out.Close()
 
-	return encoder(out, imgResized)
+	var writer io.Writer = out
+	switch outputType {
+	case JPG:
+		segments := append(metadata, iccJPEGSegments(colorProfile)...)
+		if len(segments) > 0 {
+			writer = &jpegSegmentWriter{w: out, segments: segments}
+		}
+	case PNG:
+		if colorProfile != nil {
+			writer = &pngChunkWriter{w: out, chunks: []pngChunk{iccPNGChunk(colorProfile)}}
+		}
+	}
+	if outputType == JPG && policy.TargetSSIM > 0 {
+		encoded, chosen, encoding, score, err := searchJpegQuality(imgResized, policy, encoder, ui)
+		if err != nil {
+			return err
+		}
+		if _, err := writer.Write(encoded.Bytes()); err != nil {
+			return fmt.Errorf("Could not write output file %s: %w", request.OutputPath, err)
+		}
+		request.Target.QualityMetric = "ssim"
+		request.Target.QualityScore = score
+		request.Target.ImageSettings = chosen.describe(outputType.String(), imgResized.Bounds().Size(), encoding)
+		return nil
+	}
+
+	encoding, err := encoder(writer, imgResized, policy, ui)
+	if err != nil {
+		return err
+	}
+	if encoding.SSIM > 0 {
+		request.Target.QualityMetric = "ssim"
+		request.Target.QualityScore = encoding.SSIM
+	}
+	request.Target.ImageSettings = policy.describe(outputType.String(), imgResized.Bounds().Size(), encoding)
+	return nil
 }
 
 func ShrinkPNG(request ProcessingRequest, ui UI) error {
@@ -68,3 +200,21 @@ func ShrinkPNG(request ProcessingRequest, ui UI) error {
 func ShrinkJPG(request ProcessingRequest, ui UI) error {
 	return ShrinkImage(request, encodeJpeg, ui)
 }
+
+// writeEncoderSource writes the image for the external encoders, which take a file.
+// A fast png is good enough since it's lossless anyway.
+func writeEncoderSource(request ProcessingRequest, img image.Image) (string, error) {
+	sourcePath := request.OutputPath + ".png"
+	source, err := os.Create(sourcePath)
+	if err != nil {
+		return "", fmt.Errorf("Could not create temporary file %s: %w", sourcePath, err)
+	}
+	encoder := png.Encoder{CompressionLevel: png.BestSpeed}
+	err = encoder.Encode(source, img)
+	source.Close()
+	if err != nil {
+		os.Remove(sourcePath)
+		return "", fmt.Errorf("Could not write temporary file %s: %w", sourcePath, err)
+	}
+	return sourcePath, nil
+}
@@ -0,0 +1,330 @@
+package media_shrinker
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"sort"
+)
+
+// Lossless png optimisation. image/png always writes the colour type of the image it's given, and
+// picks the row filters itself (none at all for paletted images). Here the image is reduced to the
+// smallest colour type that holds it exactly (palette, gray, gray with alpha, RGB, or RGBA), and
+// written with each of the row filters; the smallest file wins, as long as it decodes to exactly
+// the same pixels as the image, and as the file of image/png.
+//
+// The written file has no ancillary chunks, besides the colour profile added by pngChunkWriter.
+
+// PNG colour types
+const (
+	pngGray      = 0
+	pngRGB       = 2
+	pngPalette   = 3
+	pngGrayAlpha = 4
+	pngRGBA      = 6
+)
+
+var pngFilterNames = []string{"none", "sub", "up", "average", "paeth", "adaptive"}
+
+const pngAdaptive = 5
+
+var zlibLevels = map[string]int{
+	"default": zlib.DefaultCompression,
+	"none":    zlib.NoCompression,
+	"fast":    zlib.BestSpeed,
+	"best":    zlib.BestCompression,
+}
+
+// pngLayout is how the pixels are stored in the file
+type pngLayout struct {
+	colorType, bitDepth int
+	palette             []color.NRGBA
+	index               map[[4]uint8]uint8
+}
+
+func (layout *pngLayout) channels() int {
+	switch layout.colorType {
+	case pngGrayAlpha:
+		return 2
+	case pngRGB:
+		return 3
+	case pngRGBA:
+		return 4
+	}
+	return 1
+}
+
+func (layout *pngLayout) String() string {
+	names := map[int]string{pngGray: "gray", pngRGB: "rgb", pngPalette: "palette", pngGrayAlpha: "gray+alpha", pngRGBA: "rgba"}
+	return fmt.Sprintf("%s %d-bit", names[layout.colorType], layout.bitDepth)
+}
+
+// optimizePNG returns the smallest encoding of the image that's pixel identical to baseline, the
+// output of image/png, with a description like "palette 4-bit paeth". It returns nil if none is smaller.
+func optimizePNG(img image.Image, baseline []byte, policy *ImagePolicy) ([]byte, string, error) {
+	reference, err := png.Decode(bytes.NewReader(baseline))
+	if err != nil {
+		return nil, "", fmt.Errorf("Could not decode png: %w", err)
+	}
+
+	bounds := img.Bounds()
+	src := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(src, src.Rect, img, bounds.Min, draw.Src)
+	layout := reducePNGLayout(src)
+
+	level, ok := zlibLevels[policy.PNGCompression]
+	if !ok {
+		level = zlib.BestCompression
+	}
+
+	var best []byte
+	var description string
+	for filter, name := range pngFilterNames {
+		encoded, err := encodePNGLayout(src, layout, filter, level)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(encoded) >= len(baseline) || (best != nil && len(encoded) >= len(best)) {
+			continue
+		}
+		decoded, err := png.Decode(bytes.NewReader(encoded))
+		if err != nil || !samePixels(reference, decoded) || !samePixels(src, decoded) {
+			// the image has more precision than 8 bits, or the reduction went wrong
+			return nil, "", nil
+		}
+		best, description = encoded, layout.String()+" "+name
+	}
+	return best, description, nil
+}
+
+// reducePNGLayout finds the smallest colour type that keeps every pixel
+func reducePNGLayout(src *image.NRGBA) *pngLayout {
+	gray, opaque := true, true
+	colors := make(map[[4]uint8]bool)
+	for i := 0; i < len(src.Pix); i += 4 {
+		c := pixelAt(src.Pix, i)
+		if c[3] != 255 {
+			opaque = false
+		}
+		if c[0] != c[1] || c[1] != c[2] {
+			gray = false
+		}
+		if len(colors) <= 256 {
+			colors[c] = true
+		}
+	}
+
+	switch {
+	case gray && opaque && len(colors) > 16:
+		return &pngLayout{colorType: pngGray, bitDepth: 8}
+	case len(colors) <= 256:
+		layout := &pngLayout{colorType: pngPalette, index: make(map[[4]uint8]uint8)}
+		// the entries with alpha go first, so the tRNS chunk can stop at the last of them,
+		// and then by value, so the same image always gives the same file
+		sorted := make([][4]uint8, 0, len(colors))
+		for c := range colors {
+			sorted = append(sorted, c)
+		}
+		sort.Slice(sorted, func(i, j int) bool {
+			a, b := sorted[i], sorted[j]
+			if translucentA, translucentB := a[3] != 255, b[3] != 255; translucentA != translucentB {
+				return translucentA
+			}
+			for channel := range a {
+				if a[channel] != b[channel] {
+					return a[channel] < b[channel]
+				}
+			}
+			return false
+		})
+		for _, c := range sorted {
+			layout.index[c] = uint8(len(layout.palette))
+			layout.palette = append(layout.palette, nrgba(c))
+		}
+		switch {
+		case len(colors) <= 2:
+			layout.bitDepth = 1
+		case len(colors) <= 4:
+			layout.bitDepth = 2
+		case len(colors) <= 16:
+			layout.bitDepth = 4
+		default:
+			layout.bitDepth = 8
+		}
+		return layout
+	case gray:
+		return &pngLayout{colorType: pngGrayAlpha, bitDepth: 8}
+	case opaque:
+		return &pngLayout{colorType: pngRGB, bitDepth: 8}
+	}
+	return &pngLayout{colorType: pngRGBA, bitDepth: 8}
+}
+
+// encodePNGLayout writes a whole png file with the given layout, row filter and zlib level
+func encodePNGLayout(src *image.NRGBA, layout *pngLayout, filter int, level int) ([]byte, error) {
+	width, height := src.Rect.Dx(), src.Rect.Dy()
+	channels := layout.channels()
+	rowLength := (width*channels*layout.bitDepth + 7) / 8
+	pixelLength := maxInt(1, channels*layout.bitDepth/8) // how far back the filters look
+
+	var data bytes.Buffer
+	compressor, err := zlib.NewWriterLevel(&data, level)
+	if err != nil {
+		return nil, err
+	}
+	previous, current := make([]byte, rowLength), make([]byte, rowLength)
+	filtered := make([][]byte, len(pngFilterNames)-1)
+	for i := range filtered {
+		filtered[i] = make([]byte, rowLength+1)
+		filtered[i][0] = byte(i)
+	}
+	for y := 0; y < height; y++ {
+		packPNGRow(current, src.Pix[y*src.Stride:], width, layout)
+		chosen := filter
+		if filter == pngAdaptive {
+			chosen = 0
+			bestSum := -1
+			for f := range filtered {
+				sum := filterPNGRow(filtered[f][1:], current, previous, f, pixelLength)
+				if bestSum < 0 || sum < bestSum {
+					chosen, bestSum = f, sum
+				}
+			}
+		} else {
+			filterPNGRow(filtered[chosen][1:], current, previous, chosen, pixelLength)
+		}
+		if _, err := compressor.Write(filtered[chosen]); err != nil {
+			return nil, err
+		}
+		previous, current = current, previous
+	}
+	if err := compressor.Close(); err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	out.Write(pngSignature)
+	header := make([]byte, 13)
+	binary.BigEndian.PutUint32(header[0:], uint32(width))
+	binary.BigEndian.PutUint32(header[4:], uint32(height))
+	header[8], header[9] = byte(layout.bitDepth), byte(layout.colorType)
+	writePNGChunk(&out, pngChunk{Type: "IHDR", Data: header})
+	if layout.colorType == pngPalette {
+		var palette, alphas []byte
+		for _, c := range layout.palette {
+			palette = append(palette, c.R, c.G, c.B)
+			if c.A != 255 {
+				alphas = append(alphas, c.A)
+			}
+		}
+		writePNGChunk(&out, pngChunk{Type: "PLTE", Data: palette})
+		if len(alphas) > 0 {
+			writePNGChunk(&out, pngChunk{Type: "tRNS", Data: alphas})
+		}
+	}
+	writePNGChunk(&out, pngChunk{Type: "IDAT", Data: data.Bytes()})
+	writePNGChunk(&out, pngChunk{Type: "IEND"})
+	return out.Bytes(), nil
+}
+
+// packPNGRow converts a row of NRGBA pixels to the bytes of the layout
+func packPNGRow(row []byte, pix []byte, width int, layout *pngLayout) {
+	if layout.colorType == pngPalette {
+		for i := range row {
+			row[i] = 0
+		}
+		perByte := 8 / layout.bitDepth
+		for x := 0; x < width; x++ {
+			index := layout.index[pixelAt(pix, x*4)]
+			shift := uint(8 - layout.bitDepth*(x%perByte+1))
+			row[x/perByte] |= index << shift
+		}
+		return
+	}
+	for x := 0; x < width; x++ {
+		p := pix[x*4 : x*4+4]
+		switch layout.colorType {
+		case pngGray:
+			row[x] = p[0]
+		case pngGrayAlpha:
+			row[x*2], row[x*2+1] = p[0], p[3]
+		case pngRGB:
+			copy(row[x*3:], p[:3])
+		case pngRGBA:
+			copy(row[x*4:], p)
+		}
+	}
+}
+
+// filterPNGRow applies one of the five filters of the format, and returns the sum of the
+// filtered bytes as signed values, which the adaptive strategy minimizes
+func filterPNGRow(out, row, previous []byte, filter int, pixelLength int) int {
+	sum := 0
+	for i := range row {
+		var left, upLeft byte
+		if i >= pixelLength {
+			left, upLeft = row[i-pixelLength], previous[i-pixelLength]
+		}
+		up := previous[i]
+		var predicted byte
+		switch filter {
+		case 1:
+			predicted = left
+		case 2:
+			predicted = up
+		case 3:
+			predicted = byte((int(left) + int(up)) / 2)
+		case 4:
+			predicted = paeth(left, up, upLeft)
+		}
+		out[i] = row[i] - predicted
+		if signed := int(int8(out[i])); signed < 0 {
+			sum -= signed
+		} else {
+			sum += signed
+		}
+	}
+	return sum
+}
+
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := absInt(p-int(a)), absInt(p-int(b)), absInt(p-int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	}
+	if pb <= pc {
+		return b
+	}
+	return c
+}
+
+func absInt(a int) int {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
+
+// samePixels compares two decoded images; the colour of fully transparent pixels doesn't count
+func samePixels(a, b image.Image) bool {
+	if a.Bounds() != b.Bounds() {
+		return false
+	}
+	bounds := a.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r1, g1, b1, a1 := a.At(x, y).RGBA()
+			r2, g2, b2, a2 := b.At(x, y).RGBA()
+			if a1 != a2 || (a1 != 0 && (r1 != r2 || g1 != g2 || b1 != b2)) {
+				return false
+			}
+		}
+	}
+	return true
+}
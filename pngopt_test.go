@@ -0,0 +1,198 @@
+package media_shrinker
+
+import (
+	"bytes"
+	"compress/zlib"
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand"
+	"testing"
+)
+
+// testPaletteImage has n distinct colours, a third of them translucent, in an image with an odd width
+func testPaletteImage(n int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 17, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 17; x++ {
+			i := (x + y*17) % n
+			c := color.NRGBA{uint8(i), uint8(255 - i), uint8(i * 7), 255}
+			if i%3 == 1 {
+				c.A = 128
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+// testGradientImage has more than 256 colours, made by the function of the coordinates
+func testGradientImage(fn func(x, y int) color.NRGBA) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 21, 19))
+	for y := 0; y < 19; y++ {
+		for x := 0; x < 21; x++ {
+			img.SetNRGBA(x, y, fn(x, y))
+		}
+	}
+	return img
+}
+
+// testSameNRGBA compares the images exactly, as non-premultiplied colours
+func testSameNRGBA(a, b image.Image) bool {
+	if a.Bounds().Size() != b.Bounds().Size() {
+		return false
+	}
+	offsetA, offsetB := a.Bounds().Min, b.Bounds().Min
+	size := a.Bounds().Size()
+	for y := 0; y < size.Y; y++ {
+		for x := 0; x < size.X; x++ {
+			ca := color.NRGBAModel.Convert(a.At(offsetA.X+x, offsetA.Y+y))
+			cb := color.NRGBAModel.Convert(b.At(offsetB.X+x, offsetB.Y+y))
+			if ca != cb {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestEncodePNGLayout(t *testing.T) {
+	tests := []struct {
+		name      string
+		img       *image.NRGBA
+		colorType int
+		bitDepth  int
+	}{
+		{"gray", testGradientImage(func(x, y int) color.NRGBA {
+			v := uint8(x*11 + y*3)
+			return color.NRGBA{v, v, v, 255}
+		}), pngGray, 8},
+		{"palette of 2", testPaletteImage(2), pngPalette, 1},
+		{"palette of 4", testPaletteImage(4), pngPalette, 2},
+		{"palette of 16", testPaletteImage(16), pngPalette, 4},
+		{"palette of 256", testPaletteImage(256), pngPalette, 8},
+		{"gray and alpha", testGradientImage(func(x, y int) color.NRGBA {
+			v := uint8(x * 12)
+			return color.NRGBA{v, v, v, uint8(10 + y*12)}
+		}), pngGrayAlpha, 8},
+		{"rgb", testGradientImage(func(x, y int) color.NRGBA {
+			return color.NRGBA{uint8(x * 12), uint8(y * 13), uint8((x + y) * 5), 255}
+		}), pngRGB, 8},
+		{"rgba", testGradientImage(func(x, y int) color.NRGBA {
+			return color.NRGBA{uint8(x * 12), uint8(y * 13), uint8((x + y) * 5), uint8(1 + (x*y)%250)}
+		}), pngRGBA, 8},
+	}
+	for _, test := range tests {
+		layout := reducePNGLayout(test.img)
+		if layout.colorType != test.colorType || layout.bitDepth != test.bitDepth {
+			t.Errorf("%s: layout %s, want %s", test.name, layout, &pngLayout{colorType: test.colorType, bitDepth: test.bitDepth})
+			continue
+		}
+		for filter, filterName := range pngFilterNames {
+			encoded, err := encodePNGLayout(test.img, layout, filter, zlib.BestCompression)
+			if err != nil {
+				t.Fatalf("%s %s: %v", test.name, filterName, err)
+			}
+			decoded, err := png.Decode(bytes.NewReader(encoded))
+			if err != nil {
+				t.Errorf("%s %s: %v", test.name, filterName, err)
+				continue
+			}
+			if !testSameNRGBA(test.img, decoded) {
+				t.Errorf("%s %s: the pixels changed", test.name, filterName)
+			}
+		}
+	}
+}
+
+func TestReducePNGLayoutPaletteOrder(t *testing.T) {
+	for _, n := range []int{2, 4, 16, 256} {
+		layout := reducePNGLayout(testPaletteImage(n))
+		// the tRNS chunk only covers the entries up to the last translucent one
+		opaque := false
+		for _, c := range layout.palette {
+			if c.A == 255 {
+				opaque = true
+			} else if opaque {
+				t.Errorf("%d colours: translucent entry %v after an opaque one", n, c)
+				break
+			}
+		}
+		// the same image always gives the same palette
+		if again := reducePNGLayout(testPaletteImage(n)); len(again.palette) != len(layout.palette) {
+			t.Errorf("%d colours: palette of %d, then of %d", n, len(layout.palette), len(again.palette))
+		} else {
+			for index := range layout.palette {
+				if again.palette[index] != layout.palette[index] {
+					t.Errorf("%d colours: the palette order changed", n)
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestReducePNGLayoutTransparent(t *testing.T) {
+	// fully transparent pixels of any colour are a single palette entry
+	img := testPaletteImage(4)
+	img.SetNRGBA(0, 0, color.NRGBA{200, 100, 50, 0})
+	img.SetNRGBA(1, 0, color.NRGBA{10, 20, 30, 0})
+	layout := reducePNGLayout(img)
+	if len(layout.palette) != 5 {
+		t.Errorf("palette of %d colours, want 5", len(layout.palette))
+	}
+}
+
+func TestOptimizePNG(t *testing.T) {
+	policy := DefaultGraphicPolicy
+	// noise, which image/png can't compress down to a few bytes
+	random := rand.New(rand.NewSource(1))
+	noise := func(n int) *image.NRGBA {
+		palette := testPaletteImage(n)
+		img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+		for i := 0; i < len(img.Pix); i += 4 {
+			copy(img.Pix[i:i+4], palette.Pix[random.Intn(n)*4:])
+		}
+		return img
+	}
+	for _, img := range []*image.NRGBA{noise(16), noise(256)} {
+		var baseline bytes.Buffer
+		if err := png.Encode(&baseline, img); err != nil {
+			t.Fatal(err)
+		}
+		optimized, description, err := optimizePNG(img, baseline.Bytes(), &policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if optimized == nil {
+			t.Errorf("%d colours: nothing smaller than the %d bytes of image/png", len(reducePNGLayout(img).palette), baseline.Len())
+			continue
+		}
+		if len(optimized) >= baseline.Len() {
+			t.Errorf("%s: %d bytes, not smaller than %d", description, len(optimized), baseline.Len())
+		}
+		decoded, err := png.Decode(bytes.NewReader(optimized))
+		if err != nil || !testSameNRGBA(img, decoded) {
+			t.Errorf("%s: doesn't decode to the same pixels: %v", description, err)
+		}
+	}
+}
+
+func TestPaeth(t *testing.T) {
+	tests := []struct {
+		a, b, c, want byte
+	}{
+		{0, 0, 0, 0},
+		{10, 20, 10, 20},  // p = 20, closest to b
+		{20, 10, 10, 20},  // p = 20, closest to a
+		{10, 20, 30, 10},  // p = 0, closest to a
+		{100, 50, 75, 75}, // p = 75, exactly c
+		{255, 255, 0, 255},
+		{5, 5, 5, 5}, // ties go to a, then b
+	}
+	for _, test := range tests {
+		if got := paeth(test.a, test.b, test.c); got != test.want {
+			t.Errorf("paeth(%d, %d, %d) = %d, want %d", test.a, test.b, test.c, got, test.want)
+		}
+	}
+}
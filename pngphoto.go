@@ -0,0 +1,83 @@
+package media_shrinker
+
+import (
+	"image"
+	"image/draw"
+	"os"
+	"path"
+)
+
+// Some apps save camera photos as png, many times bigger than the same photo as jpg. Those are
+// shrunk with the photo policy instead, to jpg or to its format, when the graphic policy allows it;
+// screenshots and drawings stay png.
+//
+// A photo has no transparency, lots of distinct colours, and noise: neighbouring pixels are
+// rarely exactly the same, and there are few of the sharp edges of text and lines.
+
+const (
+	photoMinColorRatio     = 0.05 // distinct colours per pixel
+	photoMaxFlatRatio      = 0.3  // neighbours with exactly the same colour
+	photoMaxSharpRatio     = 0.08 // neighbours whose luma differs by more than photoSharpEdge
+	photoSharpEdge         = 64
+	photoMinClassifyPixels = 64 * 64
+)
+
+// photoOutputName is the name of the output of a photographic png, or empty if the png can't
+// become a photo, because a jpg of the same name sits next to it and could get the same output name
+func photoOutputName(opts *Options, mediaFile *MediaFile) string {
+	if mediaFile.Type != PNG || !opts.GraphicPolicy.PhotosAsJPEG || imageFormat(opts, mediaFile) != "" {
+		return ""
+	}
+	for _, ext := range []string{".jpg", ".jpeg", ".JPG", ".JPEG"} {
+		if _, err := os.Stat(path.Join(mediaFile.Dir, replaceExt(mediaFile.Name, ext))); err == nil {
+			return ""
+		}
+	}
+	if format := policyFormat(&opts.PhotoPolicy); format != "" {
+		return replaceExt(mediaFile.Name, "."+format)
+	}
+	return replaceExt(mediaFile.Name, ".jpg")
+}
+
+// isPhotographic classifies the image as a photo, see photo*Ratio
+func isPhotographic(img image.Image) bool {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width*height < photoMinClassifyPixels {
+		return false
+	}
+	src := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(src, src.Rect, img, bounds.Min, draw.Src)
+
+	luma := func(i int) int {
+		return (299*int(src.Pix[i]) + 587*int(src.Pix[i+1]) + 114*int(src.Pix[i+2])) / 1000
+	}
+	colors := make(map[[3]uint8]bool)
+	var flat, sharp, pairs int
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := y*src.Stride + x*4
+			if src.Pix[i+3] != 255 {
+				return false // transparency only survives in png
+			}
+			colors[[3]uint8{src.Pix[i], src.Pix[i+1], src.Pix[i+2]}] = true
+			for _, neighbour := range []int{i + 4, i + src.Stride} {
+				if (neighbour == i+4 && x+1 == width) || (neighbour == i+src.Stride && y+1 == height) {
+					continue
+				}
+				pairs++
+				if src.Pix[i] == src.Pix[neighbour] && src.Pix[i+1] == src.Pix[neighbour+1] && src.Pix[i+2] == src.Pix[neighbour+2] {
+					flat++
+				}
+				if absInt(luma(i)-luma(neighbour)) > photoSharpEdge {
+					sharp++
+				}
+			}
+		}
+	}
+
+	pixels := float64(width * height)
+	return float64(len(colors))/pixels >= photoMinColorRatio &&
+		float64(flat)/float64(pairs) <= photoMaxFlatRatio &&
+		float64(sharp)/float64(pairs) <= photoMaxSharpRatio
+}
@@ -0,0 +1,227 @@
+package media_shrinker
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// The full ffprobe output (as json) for when we need more than the video dimensions
+
+type ffprobeStream struct {
+	Index        int               `json:"index"`
+	CodecType    string            `json:"codec_type"`
+	CodecName    string            `json:"codec_name"`
+	Width        int               `json:"width"`
+	Height       int               `json:"height"`
+	RFrameRate   string            `json:"r_frame_rate"`
+	AvgFrameRate string            `json:"avg_frame_rate"`
+	Duration     string            `json:"duration"`
+	Channels     int               `json:"channels"`
+	StartTime    string            `json:"start_time"`
+	Tags         map[string]string `json:"tags"`
+	SideDataList []struct {
+		Rotation float64 `json:"rotation"`
+	} `json:"side_data_list"`
+	Disposition struct {
+		AttachedPic int `json:"attached_pic"`
+	} `json:"disposition"`
+}
+
+type ffprobeFormat struct {
+	Duration string            `json:"duration"`
+	Tags     map[string]string `json:"tags"`
+}
+
+type ffprobeOutput struct {
+	Streams []ffprobeStream `json:"streams"`
+	Format  ffprobeFormat   `json:"format"`
+}
+
+type VideoInfo struct {
+	VideoSize
+
+	// Degrees the video is rotated when displayed; Width and Height are before rotation
+	Rotation int
+
+	// average frames per second
+	FrameRate float64
+
+	// Phone cameras vary the frame rate with the lighting; such videos need their timestamps kept as they are
+	VariableFrameRate bool
+
+	// Timing of the streams, in seconds, to check audio stays in sync with the video
+	VideoStart                float64
+	HasAudio                  bool
+	AudioStart, AudioDuration float64
+
+	// Number of streams of each kind; cover art counts as other
+	VideoStreams, AudioStreams, OtherStreams int
+
+	// Container and video stream tags; keys are lower case
+	Tags map[string]string
+}
+
+// probeFile runs ffprobe on the file and parses its json output
+func probeFile(inpath string) (*ffprobeOutput, error) {
+	var probeArgs = []string{
+		"-v", "fatal", "-print_format", "json", "-show_format", "-show_streams",
+		inpath,
+	}
+	probeCmd := ffprobeCommand(probeArgs...)
+	output, err := probeCmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe command failed with: %w", err)
+	}
+
+	var probe ffprobeOutput
+	if err := json.Unmarshal(output, &probe); err != nil {
+		return nil, fmt.Errorf("ffprobe output parsing failed with: %w", err)
+	}
+	return &probe, nil
+}
+
+func ProbeVideoInfo(inpath string) (out VideoInfo, err error) {
+	probe, err := probeFile(inpath)
+	if err != nil {
+		return out, fmt.Errorf("Could not get video info. %w", err)
+	}
+
+	video := probe.videoStream()
+	if video == nil {
+		return out, fmt.Errorf("Could not get video info. No video stream in %s", inpath)
+	}
+
+	out.Width = video.Width
+	out.Height = video.Height
+	out.Duration = parseFloat(video.Duration)
+	if out.Duration == 0 {
+		out.Duration = parseFloat(probe.Format.Duration)
+	}
+	out.Rotation = videoRotation(video)
+	out.FrameRate = parseFrameRate(video.AvgFrameRate)
+	out.VariableFrameRate = isVariableFrameRate(video)
+	out.VideoStart = parseFloat(video.StartTime)
+
+	for _, stream := range probe.Streams {
+		switch {
+		case stream.CodecType == "video" && stream.Disposition.AttachedPic == 0:
+			out.VideoStreams++
+		case stream.CodecType == "audio":
+			out.AudioStreams++
+		default:
+			out.OtherStreams++
+		}
+	}
+
+	if audio := probe.audioStream(); audio != nil {
+		out.HasAudio = true
+		out.AudioStart = parseFloat(audio.StartTime)
+		out.AudioDuration = parseFloat(audio.Duration)
+	}
+
+	out.Tags = make(map[string]string)
+	for key, value := range probe.Format.Tags {
+		out.Tags[strings.ToLower(key)] = value
+	}
+	for key, value := range video.Tags {
+		out.Tags[strings.ToLower(key)] = value
+	}
+	return out, nil
+}
+
+func (probe *ffprobeOutput) videoStream() *ffprobeStream {
+	for index := range probe.Streams {
+		if probe.Streams[index].CodecType == "video" {
+			return &probe.Streams[index]
+		}
+	}
+	return nil
+}
+
+// DisplaySize is the size of the video the way it's shown, which is also how ffmpeg filters see it
+func (info *VideoInfo) DisplaySize() (width, height int) {
+	if info.Rotation%180 != 0 {
+		return info.Height, info.Width
+	}
+	return info.Width, info.Height
+}
+
+// videoRotation reads the rotation from the display matrix, or from the "rotate" tag used by older ffmpeg versions
+func videoRotation(video *ffprobeStream) int {
+	rotation := 0
+	for _, sideData := range video.SideDataList {
+		if sideData.Rotation != 0 {
+			rotation = int(math.Round(sideData.Rotation))
+		}
+	}
+	if rotation == 0 {
+		if tag, ok := video.Tags["rotate"]; ok {
+			rotation, _ = strconv.Atoi(tag)
+		}
+	}
+	return rotation
+}
+
+type AudioInfo struct {
+	// in seconds
+	Duration float64
+
+	Channels int
+	Codec    string
+}
+
+func ProbeAudioInfo(inpath string) (out AudioInfo, err error) {
+	probe, err := probeFile(inpath)
+	if err != nil {
+		return out, fmt.Errorf("Could not get audio info. %w", err)
+	}
+
+	audio := probe.audioStream()
+	if audio == nil {
+		return out, fmt.Errorf("Could not get audio info. No audio stream in %s", inpath)
+	}
+	out.Duration = parseFloat(audio.Duration)
+	if out.Duration == 0 {
+		out.Duration = parseFloat(probe.Format.Duration)
+	}
+	out.Channels = audio.Channels
+	out.Codec = audio.CodecName
+	return out, nil
+}
+
+func (probe *ffprobeOutput) audioStream() *ffprobeStream {
+	for index := range probe.Streams {
+		if probe.Streams[index].CodecType == "audio" {
+			return &probe.Streams[index]
+		}
+	}
+	return nil
+}
+
+// isVariableFrameRate compares the base frame rate (the one all timestamps fit in) with the average one.
+// They are the same for constant frame rate videos.
+func isVariableFrameRate(video *ffprobeStream) bool {
+	base := parseFrameRate(video.RFrameRate)
+	average := parseFrameRate(video.AvgFrameRate)
+	if base == 0 || average == 0 {
+		return false
+	}
+	return math.Abs(base-average)/base > 0.01
+}
+
+func parseFloat(s string) float64 {
+	f, _ := strconv.ParseFloat(s, 64)
+	return f
+}
+
+// parseFrameRate parses the fractions ffprobe uses for frame rates, like "30000/1001"
+func parseFrameRate(rate string) float64 {
+	var num, den float64
+	if _, err := fmt.Sscanf(rate, "%g/%g", &num, &den); err != nil || den == 0 {
+		return 0
+	}
+	return num / den
+}
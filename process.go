@@ -5,6 +5,7 @@ import (
 	"log"
 	"time"
 	"os"
+	"io/ioutil"
 	"path"
 	"strings"
 	"sort"
@@ -14,6 +15,7 @@ func (m MediaType) String() string {
 	switch m {
 		case UnknownType: return "!unknown!"
 		case Video: return "video"
+		case Audio: return "audio"
 		case PNG: return "png"
 		case JPG: return "jpg"
 	}
@@ -23,13 +25,55 @@ func (m MediaType) String() string {
 func guessMediaType(filename string) MediaType {
 	ext := strings.ToLower(path.Ext(filename))
 	switch ext {
-		case ".mp4": return Video
+		case ".mp4", ".mov": return Video
+		case ".wav", ".m4a", ".amr", ".aac", ".opus": return Audio
 		case ".jpg", ".jpeg": return JPG
 		case ".png": return PNG
 		default: return UnknownType
 	}
 }
 
+// OutputName is the name the shrunk file gets in the destination directory.
+// Videos are written as mp4 (or as an HLS package directory), audio in the container of its codec,
+// and images keep their format unless their policy asks for webp or avif.
+func OutputName(opts *Options, mediaFile *MediaFile) string {
+	switch mediaFile.Type {
+		case Video:
+			if opts.VideoMode == HLSMode {
+				return replaceExt(mediaFile.Name, hlsExt)
+			}
+			return replaceExt(mediaFile.Name, ".mp4")
+		case Audio: return replaceExt(mediaFile.Name, audioExt(audioCodec(opts)))
+		case JPG, PNG:
+			if format := imageFormat(opts, mediaFile); format != "" {
+				return replaceExt(mediaFile.Name, "."+format)
+			}
+	}
+	return mediaFile.Name
+}
+
+// outputCandidates lists the names a shrunk version of the file could have in the destination directory.
+// When shrinking didn't help, the original is copied under its own name.
+func outputCandidates(opts *Options, mediaFile *MediaFile) []string {
+	candidates := []string{OutputName(opts, mediaFile)}
+	// an HLS package is never replaced by the original
+	if mediaFile.Type == Video && opts.VideoMode == HLSMode {
+		return candidates
+	}
+	if candidates[0] != mediaFile.Name {
+		candidates = append(candidates, mediaFile.Name)
+	}
+	// a png may have been shrunk like a photo, if it is one
+	if name := photoOutputName(opts, mediaFile); name != "" {
+		candidates = append(candidates, name)
+	}
+	return candidates
+}
+
+func replaceExt(name string, ext string) string {
+	return strings.TrimSuffix(name, path.Ext(name)) + ext
+}
+
 func ListMediaFiles(dir string) ([]MediaFile, error) {
 	f, err := os.Open(dir)
 	if err != nil {
@@ -58,6 +102,22 @@ func ListMediaFiles(dir string) ([]MediaFile, error) {
 	return files, nil
 }
 
+// listFileSizes lists the sizes of all the files in dir, including the ones that are not media files
+// we take as input, like webp images
+func listFileSizes(dir string) (map[string]int, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing directory %s: %w", dir, err)
+	}
+	sizes := make(map[string]int)
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() {
+			sizes[entry.Name()] = int(entry.Size())
+		}
+	}
+	return sizes, nil
+}
+
 const KB = 1 << 10
 const MB = 1 << 20
 const GB = 1 << 30
@@ -92,27 +152,45 @@ func ProcessMediaFile(app *ProcessorData, mediaFile *MediaFile, ui UI) {
 		return
 	}
 
-	outputPath := path.Join(app.DstDir, mediaFile.Name)
-	tempPath := path.Join(app.TmpDir, mediaFile.Name)
+	mediaFile.OutputName = OutputName(&app.Options, mediaFile)
+	tempPath := path.Join(app.TmpDir, mediaFile.OutputName)
 
 	mediaFile.Stage = ProcessingInProgress
 	var result error
 
+	fileLog, err := OpenFileLog(app.LogsDir, mediaFile.Name)
+	if err != nil {
+		ui.Logf("Could not create log file for %s: %v", mediaFile.Name, err)
+	}
+	defer func() {
+		// only keep the log when something went wrong
+		if mediaFile.Error != nil && fileLog != nil {
+			fileLog.Close()
+			mediaFile.LogPath = fileLog.Path
+		} else {
+			fileLog.Remove()
+		}
+	}()
+
 	request := ProcessingRequest{
 		Target: mediaFile,
 		InputPath: inputPath,
 		OutputPath: tempPath,
+		Options: &app.Options,
+		Log: fileLog,
 	}
 
 	switch mediaFile.Type {
 		case Video:
 			result = ShrinkMovie(request, ui)
+		case Audio:
+			result = ShrinkAudio(request, ui)
 		case JPG:
 			result = ShrinkJPG(request, ui)
 		case PNG:
 			result = ShrinkPNG(request, ui)
 		default:
-			result = fmt.Errorf("*** ERROR: unsupported media type:", mediaFile.Type)
+			result = fmt.Errorf("*** ERROR: unsupported media type: %v", mediaFile.Type)
 	}
 
 	ui.Update()
@@ -126,33 +204,56 @@ func ProcessMediaFile(app *ProcessorData, mediaFile *MediaFile, ui UI) {
 		return
 	}
 
+	// the output name can change while shrinking, if a better format was picked
+	tempPath = path.Join(app.TmpDir, mediaFile.OutputName)
+	outputPath := path.Join(app.DstDir, mediaFile.OutputName)
+
 	tempFileInfo, err := os.Stat(tempPath)
 	if err != nil {
 		mediaFile.Error = fmt.Errorf("Can't find output file: %w", err)
 		log.Println(mediaFile.Error)
 		return
 	}
+	tempSize, err := pathSize(tempPath)
+	if err != nil {
+		mediaFile.Error = fmt.Errorf("Can't read output file size: %w", err)
+		log.Println(mediaFile.Error)
+		return
+	}
 
 	mediaFile.Stage = ProcessingSuccess
 	mediaFile.Error = nil
 
 	var renameError error
 
-	if int(tempFileInfo.Size()) > int(inputFileInfo.Size()) {
-		ui.Logf("Converted file (%s) is bigger than input file (%s)! using input file", BytesSize(int(tempFileInfo.Size())), BytesSize(int(inputFileInfo.Size())))
+	// a package of several renditions is allowed to be bigger than the input, and so is a remux,
+	// which only gains a few bytes of index while fixing the container
+	if !tempFileInfo.IsDir() && !mediaFile.Remuxed && tempSize > int(inputFileInfo.Size()) {
+		ui.Logf("Converted file (%s) is bigger than input file (%s)! using input file", BytesSize(tempSize), BytesSize(int(inputFileInfo.Size())))
+		// the input keeps its own name; its format didn't change, and neither did its quality
+		mediaFile.OutputName = mediaFile.Name
+		mediaFile.QualityMetric, mediaFile.QualityScore = "", 0
+		mediaFile.ImageSettings = ""
+		outputPath = path.Join(app.DstDir, mediaFile.OutputName)
 		renameError = copyFile(inputPath, outputPath)
 	} else {
-		renameError = os.Rename(tempPath, outputPath)
+		if tempFileInfo.IsDir() {
+			// a directory can't be renamed over a package left by an earlier run
+			renameError = os.RemoveAll(outputPath)
+		}
+		if renameError == nil {
+			renameError = os.Rename(tempPath, outputPath)
+		}
 	}
 
 	if renameError != nil {
-		mediaFile.Error = fmt.Errorf("Conversion failed; final rename step failed: %w", err)
+		mediaFile.Error = fmt.Errorf("Conversion failed; final rename step failed: %w", renameError)
 		log.Println(mediaFile.Error)
 		return
 	}
 
 	// check the file was written properly or not
-	outFileInfo, err := os.Stat(outputPath)
+	outSize, err := pathSize(outputPath)
 	if err != nil {
 		mediaFile.Error = fmt.Errorf("could not confirm output file written: %w", err)
 		log.Println(mediaFile.Error)
@@ -162,7 +263,17 @@ func ProcessMediaFile(app *ProcessorData, mediaFile *MediaFile, ui UI) {
 	// Set the modified timestamp the same as the input file to preserve movie/image creation date
 	os.Chtimes(outputPath, inputFileInfo.ModTime(), inputFileInfo.ModTime())
 
-	mediaFile.ShrunkSize = int(outFileInfo.Size())
+	mediaFile.ShrunkSize = outSize
+
+	if err := saveQualityScore(app.LogsDir, mediaFile); err != nil {
+		ui.Logf("Could not save the quality score of %s: %v", mediaFile.Name, err)
+	}
+	if err := saveImageSettings(app.LogsDir, mediaFile); err != nil {
+		ui.Logf("Could not save the image settings of %s: %v", mediaFile.Name, err)
+	}
+	if err := ensureThumbnail(&app.Options, mediaFile, outputPath, fileLog, ui); err != nil {
+		ui.Logf("%v", err)
+	}
 	ui.Update()
 }
 
@@ -171,6 +282,10 @@ func (stats *ShrunkStats) ShrunkString() string {
 	return fmt.Sprintf("Shrunk %d files [%s] -> [%s] (%.2f%%)", stats.Count, BytesSize(stats.SizeBefore), BytesSize(stats.SizeAfter), percentage)
 }
 
+func (stats *ShrunkStats) RemuxedString() string {
+	return fmt.Sprintf("Remuxed %d videos without re-encoding [%s] -> [%s], dropped %d extra streams", stats.RemuxedCount, BytesSize(stats.RemuxedSizeBefore), BytesSize(stats.RemuxedSizeAfter), stats.DroppedStreams)
+}
+
 func (stats *ShrunkStats) CleanedString() string {
 	return fmt.Sprintf("Deleted %d files [%s]. Space opened up after shrinking: [%s]", stats.DeletedCount, BytesSize(stats.DeletedSize), BytesSize(stats.DeletedSize - stats.DeletedShrunkSize))
 }
@@ -183,6 +298,12 @@ func AccumelateStats(files []MediaFile) (stats ShrunkStats) {
 			stats.Count += 1
 			stats.SizeBefore += mediaFile.Size
 			stats.SizeAfter += mediaFile.ShrunkSize
+			if mediaFile.Remuxed {
+				stats.RemuxedCount += 1
+				stats.RemuxedSizeBefore += mediaFile.Size
+				stats.RemuxedSizeAfter += mediaFile.ShrunkSize
+				stats.DroppedStreams += mediaFile.DroppedStreams
+			}
 			if mediaFile.Deleted {
 				stats.DeletedCount += 1
 				stats.DeletedSize += mediaFile.Size
@@ -193,6 +314,31 @@ func AccumelateStats(files []MediaFile) (stats ShrunkStats) {
 	return
 }
 
+// markOutputCollisions fails files that would be shrunk to the same name as another file, like a.mov
+// and a.mp4, instead of letting them overwrite each other. The file already named like the output keeps it.
+func markOutputCollisions(opts *Options, files []MediaFile) {
+	owners := make(map[string]*MediaFile)
+	for index := range files {
+		mediaFile := &files[index]
+		if mediaFile.Type == UnknownType {
+			continue
+		}
+		name := OutputName(opts, mediaFile)
+		owner, taken := owners[name]
+		if !taken {
+			owners[name] = mediaFile
+			continue
+		}
+		loser := mediaFile
+		if mediaFile.Name == name {
+			loser, owners[name] = owner, mediaFile
+		}
+		loser.Stage = ProcessingError
+		loser.Error = fmt.Errorf("%s and %s would both be shrunk to %s", owner.Name, mediaFile.Name, name)
+		log.Println(loser.Error)
+	}
+}
+
 func InitProcessorData(opts Options) *ProcessorData {
 	srcFiles, err := ListMediaFiles(opts.SrcDir)
 	if err != nil {
@@ -200,30 +346,106 @@ func InitProcessorData(opts Options) *ProcessorData {
 		return nil
 	}
 
+	if opts.AudioCodec != OpusCodec && opts.AudioCodec != AACCodec {
+		log.Fatalf("Unknown audio codec %q", opts.AudioCodec)
+		return nil
+	}
+
+	if opts.ColorProfile != KeepColorProfile && opts.ColorProfile != SRGBColorProfile {
+		log.Fatalf("Unknown colour profile handling %q", opts.ColorProfile)
+		return nil
+	}
+
+	if opts.VideoMode != EncodeMode && opts.VideoMode != RemuxMode && opts.VideoMode != HLSMode {
+		log.Fatalf("Unknown video mode %q", opts.VideoMode)
+		return nil
+	}
+
+	if err := SetResourceLimits(opts.Resources); err != nil {
+		log.Fatal(err)
+		return nil
+	}
+
+	// The names of shrunk files depend on the available tools
+	tools := DetectToolchain(&opts)
+	for _, policy := range []*ImagePolicy{&opts.PhotoPolicy, &opts.GraphicPolicy} {
+		if policy.Subsampling == "444" && !tools.CJpeg.Available() {
+			log.Fatalf("The %s image policy asks for 4:4:4 chroma subsampling, which needs cjpeg (-cjpeg); the built-in JPEG encoder only does 4:2:0", policy.Name)
+			return nil
+		}
+		if policy.Format != "" && !imageFormatAvailable(policy.Format) {
+			log.Printf("warning: the %s image policy asks for %s, but no encoder for it was found; keeping the original format", policy.Name, policy.Format)
+		}
+	}
+
+	markOutputCollisions(&opts, srcFiles)
+
+	if opts.LogsDir == "" {
+		opts.LogsDir = path.Join(opts.TmpDir, "logs")
+	}
+
 	// make sure destination and temporary directories exist
 	os.MkdirAll(opts.DstDir, 0o755)
 	os.MkdirAll(opts.TmpDir, 0o755)
+	if opts.ThumbsDir != "" {
+		os.MkdirAll(opts.ThumbsDir, 0o755)
+	}
 
 	// Find out which files are already processed
 	{
-		dstFiles, err := ListMediaFiles(opts.DstDir)
+		dstSizes, err := listFileSizes(opts.DstDir)
 		if err != nil {
 			log.Println(err)
+			dstSizes = make(map[string]int)
+		}
+		// HLS packages are directories, which are not listed as media files
+		packages, err := ListHLSPackages(opts.DstDir)
+		if err != nil {
+			log.Println(err)
+		}
+		for name, size := range packages {
+			dstSizes[name] = size
 		}
 
 		for index := range srcFiles {
 			srcEntry := &srcFiles[index]
+			if srcEntry.Stage == ProcessingError {
+				continue
+			}
 			// find a shrunk version of the file
-			for _, dstEntry := range dstFiles {
-				if dstEntry.Name == srcEntry.Name {
+			for _, name := range outputCandidates(&opts, srcEntry) {
+				if size, ok := dstSizes[name]; ok {
 					srcEntry.Stage = AlreadyProcessed
-					srcEntry.ShrunkSize = dstEntry.Size
+					srcEntry.ShrunkSize = size
+					srcEntry.OutputName = name
+					loadQualityScore(opts.LogsDir, srcEntry)
+					loadImageSettings(opts.LogsDir, srcEntry)
 					break
 				}
 			}
 		}
 	}
 
+	// Without ffmpeg we can still do the pictures, and without its video encoder, the audio too
+	unavailable := map[MediaType]error{
+		Video: tools.VideosUnavailable(opts.VideoMode),
+		Audio: tools.AudioUnavailable(),
+	}
+	for _, mtype := range []MediaType{Video, Audio} {
+		err := unavailable[mtype]
+		if err == nil {
+			continue
+		}
+		log.Printf("%s files will not be processed: %v", mtype, err)
+		for index := range srcFiles {
+			srcEntry := &srcFiles[index]
+			if srcEntry.Type == mtype && srcEntry.Stage == Waiting {
+				srcEntry.Stage = ProcessingError
+				srcEntry.Error = fmt.Errorf("%s files can't be processed: %w", srcEntry.Type, err)
+			}
+		}
+	}
+
 	// Sort by name
 	// FIXME allow the user to choose sorting method
 	sort.Slice(srcFiles, func (i, j int) bool {
@@ -233,6 +455,7 @@ func InitProcessorData(opts Options) *ProcessorData {
 	return &ProcessorData {
 		Options: opts,
 		MediaFiles: srcFiles,
+		Toolchain: tools,
 	}
 }
 
@@ -240,6 +463,11 @@ func StartProcessing(proc *ProcessorData, ui UI) {
 	// TODO: process pictures first since they are much faster to process
 	srcFiles := proc.MediaFiles
 
+	// Estimating doesn't touch anything, not even with -clean
+	if proc.Options.Estimate {
+		EstimateProcessing(proc, ui)
+		return
+	}
 
 	// Delete files that are done!
 	// Do this before other tasks ..
@@ -258,20 +486,30 @@ func StartProcessing(proc *ProcessorData, ui UI) {
 
 	// Start processing
 
-	// split the list of pictures and movies and process each in a separate goroutine
-	var pictures, videos []*MediaFile
+	// split the list of pictures, movies and audio and process each in a separate goroutine
+	var pictures, videos, audios []*MediaFile
 
 	for index := range srcFiles {
 		mediaFile := &srcFiles[index]
-		if mediaFile.Type == Video {
+		switch mediaFile.Type {
+		case Video:
 			videos = append(videos, mediaFile)
-		} else {
+		case Audio:
+			audios = append(audios, mediaFile)
+		default:
 			pictures = append(pictures, mediaFile)
 		}
 	}
 
 	process := func(files []*MediaFile) {
 		for _, mediaFile := range files {
+			// files shrunk by previous runs may still be missing their thumbnails
+			if mediaFile.Stage == AlreadyProcessed {
+				outputPath := path.Join(proc.DstDir, mediaFile.OutputName)
+				if err := ensureThumbnail(&proc.Options, mediaFile, outputPath, nil, ui); err != nil {
+					ui.Logf("%v", err)
+				}
+			}
 			if mediaFile.Stage != Waiting {
 				continue
 			}
@@ -289,7 +527,18 @@ func StartProcessing(proc *ProcessorData, ui UI) {
 		}
 	}
 	go process(pictures)
-	go process(videos)
+	go func() {
+		process(videos)
+		// only from the videos themselves; the pictures and audio may still be processing
+		results := make([]MediaFile, len(videos))
+		for index, mediaFile := range videos {
+			results[index] = *mediaFile
+		}
+		if stats := AccumelateStats(results); stats.RemuxedCount > 0 {
+			ui.Log(stats.RemuxedString())
+		}
+	}()
+	go process(audios)
 }
 
 func removeMediaFile(mediaFile *MediaFile, ui UI) error {
@@ -308,6 +557,26 @@ func fileStats(prefix string, mediaFile *MediaFile) string {
 		return fmt.Sprintf("%s %s [%s]", prefix, mediaFile.Name, BytesSize(mediaFile.Size))
 	} else {
 		percentage := float64(mediaFile.ShrunkSize)/float64(mediaFile.Size) * 100
-		return fmt.Sprintf("%s %s [%s] -> [%s] (%.2f%%)", prefix, mediaFile.Name, BytesSize(mediaFile.Size), BytesSize(mediaFile.ShrunkSize), percentage)
+		stats := fmt.Sprintf("%s %s [%s] -> [%s] (%.2f%%)", prefix, mediaFile.Name, BytesSize(mediaFile.Size), BytesSize(mediaFile.ShrunkSize), percentage)
+		if mediaFile.Remuxed {
+			stats += " [remuxed]"
+		}
+		if mediaFile.Profile != "" && mediaFile.Profile != DefaultCameraProfile.Name {
+			stats += " [" + mediaFile.Profile + "]"
+		}
+		if mediaFile.QualityMetric != "" {
+			stats += " " + mediaFile.QualityString()
+		}
+		if mediaFile.ImageSettings != "" {
+			stats += " [" + mediaFile.ImageSettings + "]"
+		}
+		if mediaFile.ColorProfile != "" {
+			stats += " [" + mediaFile.ColorProfile + "]"
+		}
+		return stats
 	}
 }
+
+func (mediaFile *MediaFile) QualityString() string {
+	return fmt.Sprintf("%s %.4f", strings.ToUpper(mediaFile.QualityMetric), mediaFile.QualityScore)
+}
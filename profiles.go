@@ -0,0 +1,185 @@
+package media_shrinker
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Screen recordings and static slideshow-like clips compress very differently from camera footage,
+// so they get their own encoder settings.
+
+var DefaultCameraProfile = VideoProfile{
+	Name: "camera",
+	CRF:  defaultCRF,
+}
+
+var DefaultScreenProfile = VideoProfile{
+	Name:         "screen",
+	CRF:          defaultCRF,
+	Tune:         "stillimage",
+	MaxFrameRate: 15,
+}
+
+// String formats the profile the same way Set parses it
+func (profile *VideoProfile) String() string {
+	if profile == nil {
+		return ""
+	}
+	parts := []string{fmt.Sprintf("crf=%d", profile.CRF)}
+	if profile.Preset != "" {
+		parts = append(parts, "preset="+profile.Preset)
+	}
+	if profile.Tune != "" {
+		parts = append(parts, "tune="+profile.Tune)
+	}
+	if profile.MaxFrameRate > 0 {
+		parts = append(parts, fmt.Sprintf("fps=%g", profile.MaxFrameRate))
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set overrides settings of the profile from a list like "crf=28,preset=slow,tune=animation,fps=15"
+func (profile *VideoProfile) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		eq := strings.Index(item, "=")
+		if eq == -1 {
+			return fmt.Errorf("expected key=value, got %q", item)
+		}
+		key, val := item[:eq], item[eq+1:]
+		switch key {
+		case "crf":
+			crf, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("invalid crf %q: %w", val, err)
+			}
+			profile.CRF = crf
+		case "preset":
+			profile.Preset = val
+		case "tune":
+			profile.Tune = val
+		case "fps":
+			fps, err := strconv.ParseFloat(val, 64)
+			if err != nil {
+				return fmt.Errorf("invalid fps %q: %w", val, err)
+			}
+			profile.MaxFrameRate = fps
+		default:
+			return fmt.Errorf("unknown video profile setting %q", key)
+		}
+	}
+	return nil
+}
+
+// chooseVideoProfile picks the encoder settings for the video based on its content
+func chooseVideoProfile(opts *Options, inpath string, info *VideoInfo, log *FileLog, ui UI) *VideoProfile {
+	if !opts.DetectScreen {
+		return &opts.CameraProfile
+	}
+	isScreen, reason := DetectScreenContent(inpath, info, opts.MotionAnalysis, log, ui)
+	if isScreen {
+		ui.Logf("%s looks like a screen recording or low motion video (%s)", inpath, reason)
+		return &opts.ScreenProfile
+	}
+	return &opts.CameraProfile
+}
+
+// Tags written by camera apps; if any of them is present, the video came from a camera
+var cameraTags = []string{
+	"make", "model", "location", "location-eng",
+	"com.apple.quicktime.make", "com.apple.quicktime.model", "com.apple.quicktime.location.iso6709",
+	"com.android.capture.fps",
+}
+
+// Screen sizes (long edge x short edge) that are not also standard video sizes like 1920x1080
+var screenSizes = [][2]int{
+	{1366, 768}, {1440, 900}, {1536, 864}, {1600, 900}, {1680, 1050}, {1920, 1200},
+	{2560, 1600}, {2880, 1800}, {3024, 1964}, {3456, 2234},
+	{1334, 750}, {1792, 828}, {2532, 1170}, {2778, 1284}, {2556, 1179}, {2796, 1290},
+	{2340, 1080}, {2400, 1080}, {3200, 1440}, {3120, 1440}, {2960, 1440},
+}
+
+// DetectScreenContent guesses whether the video is a screen recording or otherwise has very little motion,
+// and returns the reason for the guess
+func DetectScreenContent(inpath string, info *VideoInfo, motionAnalysis bool, log *FileLog, ui UI) (bool, string) {
+	for _, tag := range cameraTags {
+		if _, ok := info.Tags[tag]; ok {
+			return false, "camera metadata: " + tag
+		}
+	}
+
+	for key, value := range info.Tags {
+		if strings.Contains(strings.ToLower(key), "screen") || strings.Contains(strings.ToLower(value), "screen") {
+			return true, fmt.Sprintf("metadata %s=%s", key, value)
+		}
+	}
+
+	long, short := info.Width, info.Height
+	if short > long {
+		long, short = short, long
+	}
+	for _, size := range screenSizes {
+		if long == size[0] && short == size[1] {
+			return true, fmt.Sprintf("screen resolution %dx%d", long, short)
+		}
+	}
+	// cameras don't record anything this narrow; phone screens are about 19.5:9 or 20:9
+	if short > 0 && float64(long)/float64(short) > 2 {
+		return true, fmt.Sprintf("screen aspect ratio %dx%d", long, short)
+	}
+
+	if motionAnalysis {
+		distinct, err := MeasureMotion(inpath, info, log, ui)
+		if err != nil {
+			ui.Logf("Motion analysis of %s failed: %v", inpath, err)
+		} else if distinct < lowMotionThreshold {
+			return true, fmt.Sprintf("low motion: %.0f%% distinct frames", distinct*100)
+		}
+	}
+
+	return false, ""
+}
+
+const (
+	motionSampleLength = 30   // seconds analysed from the start of the video
+	lowMotionThreshold = 0.25 // fraction of frames that are not near duplicates of the previous one
+)
+
+// MeasureMotion returns the fraction of frames at the start of the video that differ noticeably
+// from the frame before, according to ffmpeg's mpdecimate filter
+func MeasureMotion(inpath string, info *VideoInfo, log *FileLog, ui UI) (float64, error) {
+	length := math.Min(motionSampleLength, info.Duration)
+	expectedFrames := length * info.FrameRate
+	if expectedFrames < 1 {
+		return 0, fmt.Errorf("unknown frame rate or duration")
+	}
+
+	var args = []string{
+		"-t", fmt.Sprintf("%.3f", length), "-i", inpath,
+		"-an", "-vf", "mpdecimate", "-f", "null", "-",
+	}
+	output, err := ffmpegOutput(args, log, ui)
+	if err != nil {
+		return 0, err
+	}
+
+	// the last progress line has the number of frames that went through the filter
+	frameIndex := strings.LastIndex(output, "frame=")
+	if frameIndex == -1 {
+		return 0, fmt.Errorf("no frame count in ffmpeg output")
+	}
+	fields := strings.Fields(output[frameIndex+len("frame="):])
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("no frame count in ffmpeg output")
+	}
+	frames, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, fmt.Errorf("could not parse frame count: %w", err)
+	}
+	return math.Min(float64(frames)/expectedFrames, 1), nil
+}
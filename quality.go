@@ -0,0 +1,128 @@
+package media_shrinker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Objective quality check of shrunk videos.
+//
+// ffmpeg's ssim/psnr filters compare the output against the input, put through the same filters as
+// the encode (crop, frame rate cap) and scaled down to the output's size, so that
+// neither is counted as a loss. To keep it fast, only a few short windows
+// spread over the video are compared.
+
+const (
+	qualityCRFStep = 3  // how much the crf is lowered on every retry
+	minCRF         = 14 // visually lossless; no point going further
+	qualityWindow  = 5  // seconds per sample window
+)
+
+// QualityFloorFor returns the configured floor, or a sensible default for the metric
+func (opts *Options) QualityFloorFor() float64 {
+	if opts.QualityFloor > 0 {
+		return opts.QualityFloor
+	}
+	switch opts.QualityMetric {
+	case "psnr":
+		return 38
+	default:
+		return 0.96
+	}
+}
+
+// MeasureVideoQuality compares `samples` windows of the output video against the input, filtered
+// with sourceFilters, and returns the average score for the given metric ("ssim" or "psnr").
+func MeasureVideoQuality(inpath, outpath string, sourceFilters []string, metric string, duration float64, samples int, log *FileLog, ui UI) (float64, error) {
+	if metric != "ssim" && metric != "psnr" {
+		return 0, fmt.Errorf("unknown quality metric %q", metric)
+	}
+	if samples < 1 {
+		samples = 1
+	}
+
+	var windows [][2]float64 // start, length
+	if duration <= float64(samples*qualityWindow) {
+		windows = append(windows, [2]float64{0, duration})
+	} else {
+		for i := 0; i < samples; i++ {
+			center := duration * (float64(i) + 0.5) / float64(samples)
+			windows = append(windows, [2]float64{center - qualityWindow/2.0, qualityWindow})
+		}
+	}
+
+	reference := "[1:v]"
+	if len(sourceFilters) > 0 {
+		reference = fmt.Sprintf("[1:v]%s[source];[source]", strings.Join(sourceFilters, ","))
+	}
+
+	var total float64
+	for _, window := range windows {
+		start := fmt.Sprintf("%.3f", window[0])
+		length := fmt.Sprintf("%.3f", window[1])
+		var args = []string{
+			"-ss", start, "-t", length, "-i", outpath,
+			"-ss", start, "-t", length, "-i", inpath,
+			"-lavfi", fmt.Sprintf("%s[0:v]scale2ref=flags=bicubic[ref][main];[main][ref]%s", reference, metric),
+			"-f", "null", "-",
+		}
+		output, err := ffmpegOutput(args, log, ui)
+		if err != nil {
+			return 0, err
+		}
+		score, err := parseQualityScore(output, metric)
+		if err != nil {
+			return 0, err
+		}
+		total += score
+	}
+	return total / float64(len(windows)), nil
+}
+
+// parseQualityScore finds the summary line printed by the ssim/psnr filters at the end:
+//
+//    [Parsed_ssim_1 @ 0x...] SSIM Y:0.982 (17.4) U:0.990 (20.1) V:0.989 (19.9) All:0.985 (18.2)
+//    [Parsed_psnr_1 @ 0x...] PSNR y:40.12 u:45.01 v:45.32 average:41.50 min:37.21 max:47.88
+//
+func parseQualityScore(output string, metric string) (float64, error) {
+	marker, key := "SSIM ", "All:"
+	if metric == "psnr" {
+		marker, key = "PSNR ", "average:"
+	}
+	lineIndex := strings.LastIndex(output, marker)
+	if lineIndex == -1 {
+		return 0, fmt.Errorf("no %s summary in ffmpeg output", metric)
+	}
+	line := output[lineIndex:]
+	keyIndex := strings.Index(line, key)
+	if keyIndex == -1 {
+		return 0, fmt.Errorf("could not parse %s summary: %s", metric, line)
+	}
+	fields := strings.Fields(line[keyIndex+len(key):])
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("could not parse %s summary: %s", metric, line)
+	}
+	if fields[0] == "inf" { // identical frames
+		return 1000, nil
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+// saveQualityScore records the score of the shrunk file, see saveFileRecord
+func saveQualityScore(logsDir string, mediaFile *MediaFile) error {
+	var record string
+	if mediaFile.QualityMetric != "" {
+		record = fmt.Sprintf("%s %g", mediaFile.QualityMetric, mediaFile.QualityScore)
+	}
+	return saveFileRecord(logsDir, mediaFile, "quality", record)
+}
+
+// loadQualityScore reads back the score saved by saveQualityScore, if there is one
+func loadQualityScore(logsDir string, mediaFile *MediaFile) {
+	var metric string
+	var score float64
+	if n, _ := fmt.Sscanf(loadFileRecord(logsDir, mediaFile, "quality"), "%s %g", &metric, &score); n == 2 {
+		mediaFile.QualityMetric, mediaFile.QualityScore = metric, score
+	}
+}
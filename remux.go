@@ -0,0 +1,58 @@
+package media_shrinker
+
+import "fmt"
+
+// Remux mode only fixes the container: the video and audio streams are copied as they are into an mp4
+// with the index (moov atom) at the front, so it can start playing before it's fully downloaded.
+// Everything else (data tracks like timecodes, subtitles that mp4 can't hold, cover art) is dropped.
+
+const (
+	EncodeMode = "encode"
+	RemuxMode  = "remux"
+)
+
+func RemuxMovie(request ProcessingRequest, info *VideoInfo, ui UI) error {
+	var args = []string{
+		"-y", "-i", request.InputPath,
+		"-map", "0:V", "-map", "0:a?", "-map_metadata", "0",
+		"-c", "copy", "-movflags", "+faststart",
+		"-f", "mp4", request.OutputPath,
+	}
+	err := runFFmpeg(args, request.Log, ui, func(durationProcessed float64) {
+		request.Target.Percentage = (durationProcessed / info.Duration) * 100
+		request.Target.Processed = durationProcessed
+		ui.Update()
+	})
+	if err != nil {
+		return fmt.Errorf("Remuxing failed: %w", err)
+	}
+
+	outInfo, err := ProbeVideoInfo(request.OutputPath)
+	if err != nil {
+		return fmt.Errorf("Remuxing appears to be failed because ffprobe failed: %w", err)
+	}
+	if err := checkRemux(info, &outInfo); err != nil {
+		return fmt.Errorf("Remuxing failed; %w", err)
+	}
+
+	request.Target.Remuxed = true
+	request.Target.DroppedStreams = info.OtherStreams - outInfo.OtherStreams
+	if request.Target.DroppedStreams > 0 {
+		ui.Logf("Dropped %d extra streams from %s", request.Target.DroppedStreams, request.Target.Name)
+	}
+	return nil
+}
+
+// checkRemux makes sure nothing we wanted to keep was lost or changed
+func checkRemux(in, out *VideoInfo) error {
+	if !DurationsRoughlyEqual(in.Duration, out.Duration) {
+		return fmt.Errorf("duration mismatch: %8.2f -> %8.2f", in.Duration, out.Duration)
+	}
+	if in.Width != out.Width || in.Height != out.Height || in.Rotation != out.Rotation {
+		return fmt.Errorf("video size mismatch: %dx%d (%d°) -> %dx%d (%d°)", in.Width, in.Height, in.Rotation, out.Width, out.Height, out.Rotation)
+	}
+	if in.VideoStreams != out.VideoStreams || in.AudioStreams != out.AudioStreams {
+		return fmt.Errorf("streams mismatch: %d video and %d audio -> %d video and %d audio", in.VideoStreams, in.AudioStreams, out.VideoStreams, out.AudioStreams)
+	}
+	return CheckAVSync(in, out)
+}
@@ -0,0 +1,129 @@
+package media_shrinker
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits on the ffmpeg child processes, so that a shrinking run doesn't make the machine unusable.
+
+type ResourceLimits struct {
+	Threads    int           // ffmpeg -threads and -filter_threads; 0 lets ffmpeg decide
+	Nice       int           // CPU scheduling priority, like the nice command; 0 leaves it alone
+	IOPriority string        // I/O scheduling class like the ionice command: "idle" or "best-effort:0" to "best-effort:7"
+	MaxMemory  int           // address space limit in bytes; 0 for none
+	MaxCPUTime time.Duration // CPU time limit; 0 for none
+}
+
+// The limits applied to all child processes started from now on
+var resourceLimits ResourceLimits
+
+func SetResourceLimits(limits ResourceLimits) error {
+	if _, _, err := parseIOPriority(limits.IOPriority); err != nil {
+		return err
+	}
+	resourceLimits = limits
+	return nil
+}
+
+// threadArgs adds the thread options to ffmpeg arguments. -threads is a per file option,
+// so it goes right before the output, which is always the last argument.
+func threadArgs(args []string, threads int) []string {
+	if threads <= 0 || len(args) == 0 {
+		return args
+	}
+	count := strconv.Itoa(threads)
+	out := []string{"-filter_threads", count}
+	out = append(out, args[:len(args)-1]...)
+	out = append(out, "-threads", count, args[len(args)-1])
+	return out
+}
+
+const (
+	ioPriorityClassBestEffort = 2
+	ioPriorityClassIdle       = 3
+)
+
+// parseIOPriority returns class 0 if the priority should be left alone
+func parseIOPriority(priority string) (class int, level int, err error) {
+	switch {
+	case priority == "":
+		return 0, 0, nil
+	case priority == "idle":
+		return ioPriorityClassIdle, 0, nil
+	case strings.HasPrefix(priority, "best-effort"):
+		level = 4 // the default level
+		if rest := strings.TrimPrefix(priority, "best-effort"); rest != "" {
+			level, err = strconv.Atoi(strings.TrimPrefix(rest, ":"))
+			if err != nil || level < 0 || level > 7 {
+				return 0, 0, fmt.Errorf("invalid I/O priority level in %q; expected 0 to 7", priority)
+			}
+		}
+		return ioPriorityClassBestEffort, level, nil
+	}
+	return 0, 0, fmt.Errorf("invalid I/O priority %q; expected \"idle\" or \"best-effort:N\"", priority)
+}
+
+func (limits ResourceLimits) String() string {
+	var parts []string
+	if limits.Threads > 0 {
+		parts = append(parts, fmt.Sprintf("threads=%d", limits.Threads))
+	}
+	if limits.Nice != 0 {
+		parts = append(parts, fmt.Sprintf("nice=%d", limits.Nice))
+	}
+	if limits.IOPriority != "" {
+		parts = append(parts, "io="+limits.IOPriority)
+	}
+	if limits.MaxMemory > 0 {
+		parts = append(parts, "mem="+BytesSize(limits.MaxMemory))
+	}
+	if limits.MaxCPUTime > 0 {
+		parts = append(parts, "cpu="+limits.MaxCPUTime.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+// A child process along with the limits it runs under
+type childCommand struct {
+	*exec.Cmd
+	Limits ResourceLimits
+}
+
+var runningCommands []*childCommand
+var runningCommandsMutex sync.Mutex
+
+func registerCommand(cmd *exec.Cmd) *childCommand {
+	runningCommandsMutex.Lock()
+	defer runningCommandsMutex.Unlock()
+	child := &childCommand{Cmd: cmd, Limits: resourceLimits}
+	runningCommands = append(runningCommands, child)
+	return child
+}
+
+// Start starts the process and then applies the limits to it.
+// The process runs unrestricted for a moment, which doesn't matter for ffmpeg.
+func (child *childCommand) Start() error {
+	if err := child.Cmd.Start(); err != nil {
+		return err
+	}
+	if err := applyResourceLimits(child.Process.Pid, child.Limits); err != nil {
+		return fmt.Errorf("could not apply resource limits to %s: %w", child.Path, err)
+	}
+	return nil
+}
+
+func killChildCommands() {
+	runningCommandsMutex.Lock()
+	defer runningCommandsMutex.Unlock()
+	for _, cmd := range runningCommands {
+		// can fail silently if already killed - we don't care
+		if cmd.Process != nil {
+			cmd.Process.Kill()
+		}
+	}
+}
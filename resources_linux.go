@@ -0,0 +1,53 @@
+//go:build linux
+// +build linux
+
+package media_shrinker
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+const ioPriorityWhoProcess = 1
+
+func applyResourceLimits(pid int, limits ResourceLimits) error {
+	if limits.Nice != 0 {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, pid, limits.Nice); err != nil {
+			return err
+		}
+	}
+
+	class, level, err := parseIOPriority(limits.IOPriority)
+	if err != nil {
+		return err
+	}
+	if class != 0 {
+		// ioprio_set(IOPRIO_WHO_PROCESS, pid, IOPRIO_PRIO_VALUE(class, level))
+		_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioPriorityWhoProcess, uintptr(pid), uintptr(class<<13|level))
+		if errno != 0 {
+			return errno
+		}
+	}
+
+	if limits.MaxMemory > 0 {
+		if err := prlimit(pid, syscall.RLIMIT_AS, uint64(limits.MaxMemory)); err != nil {
+			return err
+		}
+	}
+	if limits.MaxCPUTime > 0 {
+		if err := prlimit(pid, syscall.RLIMIT_CPU, uint64(limits.MaxCPUTime.Seconds())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prlimit sets both the soft and hard limit of another process
+func prlimit(pid int, resource int, value uint64) error {
+	limit := syscall.Rlimit{Cur: value, Max: value}
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(resource), uintptr(unsafe.Pointer(&limit)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package media_shrinker
+
+import "fmt"
+
+func applyResourceLimits(pid int, limits ResourceLimits) error {
+	if limits.Nice != 0 || limits.IOPriority != "" || limits.MaxMemory > 0 || limits.MaxCPUTime > 0 {
+		return fmt.Errorf("process priorities and limits are only supported on linux")
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package media_shrinker
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+)
+
+// Targeted JPEG quality: instead of one quality for every image, search for the lowest quality
+// whose SSIM against the resized image stays above the policy's target. Simple images end up
+// much smaller, and detailed ones get a higher quality than the fixed one would give them.
+//
+// SSIM is measured on the luma only, which is where the eye notices compression the most.
+
+const (
+	searchMinQuality = 30
+	searchMaxQuality = 98
+)
+
+// searchJpegQuality encodes the image at the qualities of a binary search, and returns the
+// smallest encoding that meets the target, with the policy it was encoded with and its score
+func searchJpegQuality(img image.Image, policy *ImagePolicy, encoder EncoderFn, ui UI) (*bytes.Buffer, ImagePolicy, imageEncoding, float64, error) {
+	reference := lumaPlane(img)
+
+	try := func(quality int) (*bytes.Buffer, ImagePolicy, imageEncoding, float64, error) {
+		attempt := *policy
+		attempt.Quality = quality
+		var encoded bytes.Buffer
+		encoding, err := encoder(&encoded, img, &attempt, ui)
+		if err != nil {
+			return nil, attempt, encoding, 0, err
+		}
+		decoded, err := jpeg.Decode(bytes.NewReader(encoded.Bytes()))
+		if err != nil {
+			return nil, attempt, encoding, 0, fmt.Errorf("Could not decode the encoded image: %w", err)
+		}
+		return &encoded, attempt, encoding, ssim(reference, lumaPlane(decoded)), nil
+	}
+
+	// the best quality has to meet the target, or there's nothing to search
+	best, bestPolicy, bestEncoding, bestScore, err := try(searchMaxQuality)
+	if err != nil || bestScore < policy.TargetSSIM {
+		if err == nil {
+			ui.Logf("warning: SSIM %.4f is below %.4f even at quality %d", bestScore, policy.TargetSSIM, searchMaxQuality)
+		}
+		return best, bestPolicy, bestEncoding, bestScore, err
+	}
+
+	low, high := searchMinQuality, searchMaxQuality-1
+	for low <= high {
+		quality := (low + high) / 2
+		encoded, attempt, encoding, score, err := try(quality)
+		if err != nil {
+			return nil, attempt, encoding, 0, err
+		}
+		if score >= policy.TargetSSIM {
+			best, bestPolicy, bestEncoding, bestScore = encoded, attempt, encoding, score
+			high = quality - 1
+		} else {
+			low = quality + 1
+		}
+	}
+	return best, bestPolicy, bestEncoding, bestScore, nil
+}
+
+type plane struct {
+	width, height int
+	pixels        []float64
+}
+
+// lumaPlane converts the image to its luma, as JPEG encoders compute it
+func lumaPlane(img image.Image) plane {
+	bounds := img.Bounds()
+	p := plane{width: bounds.Dx(), height: bounds.Dy()}
+	p.pixels = make([]float64, p.width*p.height)
+	index := 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			p.pixels[index] = (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 257
+			index++
+		}
+	}
+	return p
+}
+
+const (
+	ssimWindow = 8
+	ssimStride = 4
+	ssimC1     = (0.01 * 255) * (0.01 * 255)
+	ssimC2     = (0.03 * 255) * (0.03 * 255)
+)
+
+// ssim is the mean SSIM over overlapping square windows, computed with summed area tables
+func ssim(a, b plane) float64 {
+	if a.width != b.width || a.height != b.height || a.width < ssimWindow || a.height < ssimWindow {
+		return 0
+	}
+
+	// the tables have an extra row and column of zeros, so a window sum is four lookups
+	stride := a.width + 1
+	size := stride * (a.height + 1)
+	sumA, sumB := make([]float64, size), make([]float64, size)
+	sumAA, sumBB, sumAB := make([]float64, size), make([]float64, size), make([]float64, size)
+	for y := 0; y < a.height; y++ {
+		for x := 0; x < a.width; x++ {
+			pa, pb := a.pixels[y*a.width+x], b.pixels[y*a.width+x]
+			i := (y+1)*stride + x + 1
+			up, left, diagonal := i-stride, i-1, i-stride-1
+			sumA[i] = pa + sumA[up] + sumA[left] - sumA[diagonal]
+			sumB[i] = pb + sumB[up] + sumB[left] - sumB[diagonal]
+			sumAA[i] = pa*pa + sumAA[up] + sumAA[left] - sumAA[diagonal]
+			sumBB[i] = pb*pb + sumBB[up] + sumBB[left] - sumBB[diagonal]
+			sumAB[i] = pa*pb + sumAB[up] + sumAB[left] - sumAB[diagonal]
+		}
+	}
+	window := func(table []float64, x, y int) float64 {
+		x1, y1 := x+ssimWindow, y+ssimWindow
+		return table[y1*stride+x1] - table[y*stride+x1] - table[y1*stride+x] + table[y*stride+x]
+	}
+
+	const n = ssimWindow * ssimWindow
+	var total float64
+	var count int
+	for y := 0; y+ssimWindow <= a.height; y += ssimStride {
+		for x := 0; x+ssimWindow <= a.width; x += ssimStride {
+			meanA, meanB := window(sumA, x, y)/n, window(sumB, x, y)/n
+			varA := window(sumAA, x, y)/n - meanA*meanA
+			varB := window(sumBB, x, y)/n - meanB*meanB
+			covariance := window(sumAB, x, y)/n - meanA*meanB
+			total += ((2*meanA*meanB + ssimC1) * (2*covariance + ssimC2)) /
+				((meanA*meanA + meanB*meanB + ssimC1) * (varA + varB + ssimC2))
+			count++
+		}
+	}
+	return total / float64(count)
+}
@@ -0,0 +1,65 @@
+package media_shrinker
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+func testPlane(width, height int, fn func(x, y int) float64) plane {
+	p := plane{width: width, height: height, pixels: make([]float64, width*height)}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			p.pixels[y*width+x] = fn(x, y)
+		}
+	}
+	return p
+}
+
+func TestSSIM(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	noise := testPlane(32, 24, func(x, y int) float64 { return float64(random.Intn(256)) })
+	gradient := testPlane(32, 24, func(x, y int) float64 { return float64(x*8 + y) })
+	flat := testPlane(32, 24, func(x, y int) float64 { return 128 })
+	brighter := testPlane(32, 24, func(x, y int) float64 { return gradient.pixels[y*32+x] + 20 })
+
+	tests := []struct {
+		name     string
+		a, b     plane
+		min, max float64
+	}{
+		{"identical noise", noise, noise, 1, 1},
+		{"identical gradient", gradient, gradient, 1, 1},
+		{"identical flat", flat, flat, 1, 1},
+		{"brighter", gradient, brighter, 0.9, 0.9999},
+		{"unrelated", noise, gradient, -1, 0.2},
+		{"different sizes", gradient, testPlane(24, 32, func(x, y int) float64 { return 0 }), 0, 0},
+		{"smaller than a window", testPlane(7, 7, func(x, y int) float64 { return 1 }), testPlane(7, 7, func(x, y int) float64 { return 1 }), 0, 0},
+		{"narrower than a window", testPlane(7, 100, func(x, y int) float64 { return 1 }), testPlane(7, 100, func(x, y int) float64 { return 1 }), 0, 0},
+		{"one window", testPlane(8, 8, func(x, y int) float64 { return float64(x) }), testPlane(8, 8, func(x, y int) float64 { return float64(x) }), 1, 1},
+	}
+	for _, test := range tests {
+		score := ssim(test.a, test.b)
+		// identical planes score 1 up to the rounding of the summed area tables
+		if score < test.min-1e-9 || score > test.max+1e-9 {
+			t.Errorf("%s: ssim %f, want between %f and %f", test.name, score, test.min, test.max)
+		}
+	}
+}
+
+func TestLumaPlane(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(10, 20, 12, 21)) // not at the origin
+	img.SetNRGBA(10, 20, color.NRGBA{255, 255, 255, 255})
+	img.SetNRGBA(11, 20, color.NRGBA{255, 0, 0, 255})
+	p := lumaPlane(img)
+	if p.width != 2 || p.height != 1 {
+		t.Fatalf("plane is %dx%d, want 2x1", p.width, p.height)
+	}
+	if p.pixels[0] < 254.99 || p.pixels[0] > 255.01 {
+		t.Errorf("luma of white is %f, want 255", p.pixels[0])
+	}
+	if want := 0.299 * 255; p.pixels[1] < want-0.01 || p.pixels[1] > want+0.01 {
+		t.Errorf("luma of red is %f, want %f", p.pixels[1], want)
+	}
+}
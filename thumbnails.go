@@ -0,0 +1,97 @@
+package media_shrinker
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"os"
+	"path"
+
+	"github.com/disintegration/imageorient"
+	"github.com/nfnt/resize"
+)
+
+// Previews for browsing the destination directory: a poster frame for every video,
+// and a small thumbnail for every image.
+
+const (
+	thumbnailSize = 320 // long edge of image thumbnails, in pixels
+	posterWidth   = 640 // maximum width of video posters, in pixels
+)
+
+// ThumbnailPath derives the name of the preview from the name of the shrunk file,
+// so we can tell whether it already exists without keeping any state
+func ThumbnailPath(opts *Options, outputPath string) string {
+	return path.Join(opts.ThumbsDir, path.Base(outputPath)+".jpg")
+}
+
+// ensureThumbnail creates the preview of the shrunk file at outputPath, unless it already exists
+func ensureThumbnail(opts *Options, mediaFile *MediaFile, outputPath string, log *FileLog, ui UI) error {
+	if opts.ThumbsDir == "" || mediaFile.Type == Audio {
+		return nil
+	}
+	thumbPath := ThumbnailPath(opts, outputPath)
+	if _, err := os.Stat(thumbPath); err == nil {
+		return nil
+	}
+
+	var err error
+	if mediaFile.Type == Video {
+		err = makeVideoPoster(hlsPosterSource(outputPath), thumbPath, log, ui)
+	} else {
+		err = makeImageThumbnail(outputPath, thumbPath)
+		// Go can't decode webp or avif; ffmpeg can
+		if errors.Is(err, image.ErrFormat) && toolchain.FFmpeg.Available() {
+			err = makeFFmpegThumbnail(outputPath, thumbPath, log, ui)
+		}
+	}
+	if err != nil {
+		os.Remove(thumbPath)
+		return fmt.Errorf("Could not create thumbnail for %s: %w", mediaFile.Name, err)
+	}
+	return nil
+}
+
+// makeVideoPoster uses ffmpeg's thumbnail filter, which picks the most representative frame
+// out of a batch, so we don't end up with a black frame from the very start of the video
+func makeVideoPoster(inpath string, thumbPath string, log *FileLog, ui UI) error {
+	var args = []string{
+		"-y", "-i", inpath,
+		"-vf", fmt.Sprintf("thumbnail,scale='min(%d,iw)':-2", posterWidth),
+		"-frames:v", "1", "-q:v", "3",
+		thumbPath,
+	}
+	return runFFmpeg(args, log, ui, nil)
+}
+
+func makeFFmpegThumbnail(inpath string, thumbPath string, log *FileLog, ui UI) error {
+	var args = []string{
+		"-y", "-i", inpath,
+		"-vf", fmt.Sprintf("scale='min(%d,iw)':'min(%d,ih)':force_original_aspect_ratio=decrease", thumbnailSize, thumbnailSize),
+		"-frames:v", "1", "-q:v", "5",
+		thumbPath,
+	}
+	return runFFmpeg(args, log, ui, nil)
+}
+
+func makeImageThumbnail(inpath string, thumbPath string) error {
+	file, err := os.Open(inpath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	img, _, err := imageorient.Decode(file)
+	if err != nil {
+		return err
+	}
+	thumb := resize.Thumbnail(thumbnailSize, thumbnailSize, img, resize.Lanczos3)
+
+	out, err := os.Create(thumbPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	return jpeg.Encode(out, thumb, &jpeg.Options{Quality: 80})
+}
@@ -0,0 +1,249 @@
+package media_shrinker
+
+import (
+	"bufio"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// External programs we depend on. They are checked once at startup, so that instead of failing
+// every video one by one, we know upfront whether videos can be processed at all.
+
+type Tool struct {
+	Name string // as shown to the user
+	Path string // as configured, or found on PATH
+
+	Version      string
+	Major, Minor int      // parsed from Version; zero for development builds
+	Libraries    []string // external libraries the tool was built with, like "libx264"
+
+	Err error // why the tool can't be used
+
+	// Optional tools only enable extra features
+	Optional bool
+}
+
+type Toolchain struct {
+	FFmpeg, FFprobe Tool
+
+	// Image encoders. cjpeg is only used when configured.
+	CWebP, AVIFEnc, CJpeg Tool
+
+	// Decoder to verify avif images with, when ffmpeg can't
+	AVIFDec Tool
+
+	// Lossless jpeg optimizer
+	JPEGTran Tool
+
+	// Why videos can't be encoded even though ffmpeg is there, like a build without libx264.
+	// Audio, images and remuxing don't need the video encoder.
+	VideoEncoderErr error
+}
+
+// The toolchain used by all the functions that run external commands
+var toolchain = Toolchain{
+	FFmpeg:  Tool{Name: "ffmpeg", Path: "ffmpeg"},
+	FFprobe: Tool{Name: "ffprobe", Path: "ffprobe"},
+	CWebP:   Tool{Name: "cwebp", Path: "cwebp", Optional: true},
+	AVIFEnc: Tool{Name: "avifenc", Path: "avifenc", Optional: true},
+	AVIFDec: Tool{Name: "avifdec", Path: "avifdec", Optional: true},
+	CJpeg:   Tool{Name: "cjpeg", Optional: true, Err: fmt.Errorf("cjpeg is not configured")},
+
+	JPEGTran: Tool{Name: "jpegtran", Path: "jpegtran", Optional: true},
+}
+
+// ffmpegCommand is where all ffmpeg commands are made, so this is where the thread limit is added
+func ffmpegCommand(args ...string) *exec.Cmd {
+	return exec.Command(toolchain.FFmpeg.Path, threadArgs(args, resourceLimits.Threads)...)
+}
+
+func ffprobeCommand(args ...string) *exec.Cmd {
+	return exec.Command(toolchain.FFprobe.Path, args...)
+}
+
+func cwebpCommand(args ...string) *exec.Cmd {
+	return exec.Command(toolchain.CWebP.Path, args...)
+}
+
+func avifencCommand(args ...string) *exec.Cmd {
+	return exec.Command(toolchain.AVIFEnc.Path, args...)
+}
+
+func avifdecCommand(args ...string) *exec.Cmd {
+	return exec.Command(toolchain.AVIFDec.Path, args...)
+}
+
+func cjpegCommand(args ...string) *exec.Cmd {
+	return exec.Command(toolchain.CJpeg.Path, args...)
+}
+
+func jpegtranCommand(args ...string) *exec.Cmd {
+	return exec.Command(toolchain.JPEGTran.Path, args...)
+}
+
+// DetectToolchain checks the configured tools and makes them the ones used from now on
+func DetectToolchain(opts *Options) *Toolchain {
+	toolchain.FFmpeg = detectFFTool("ffmpeg", opts.FFmpegPath)
+	toolchain.FFprobe = detectFFTool("ffprobe", opts.FFprobePath)
+	toolchain.VideoEncoderErr = nil
+	if toolchain.FFmpeg.Err == nil && !toolchain.FFmpeg.HasLibrary("libx264") {
+		toolchain.VideoEncoderErr = fmt.Errorf("ffmpeg was built without libx264")
+	}
+	toolchain.CWebP = detectTool("cwebp", opts.CWebPPath, "-version")
+	toolchain.AVIFEnc = detectTool("avifenc", opts.AVIFEncPath, "--version")
+	toolchain.AVIFDec = detectTool("avifdec", opts.AVIFDecPath, "--version")
+	if opts.CJpegPath != "" {
+		toolchain.CJpeg = detectTool("cjpeg", opts.CJpegPath, "-version")
+	}
+	toolchain.JPEGTran = detectTool("jpegtran", opts.JPEGTranPath, "-version")
+	return &toolchain
+}
+
+func (t *Tool) Available() bool {
+	return t.Err == nil
+}
+
+func (t *Tool) HasLibrary(name string) bool {
+	for _, lib := range t.Libraries {
+		if lib == name {
+			return true
+		}
+	}
+	return false
+}
+
+// AtLeast tells whether the tool is at least the given version. Development builds don't
+// have a version number, but they are usually recent, so we assume they are new enough.
+func (t *Tool) AtLeast(major, minor int) bool {
+	if t.Major == 0 && t.Minor == 0 {
+		return true
+	}
+	return t.Major > major || (t.Major == major && t.Minor >= minor)
+}
+
+// Tools lists all the tools, for display
+func (tc *Toolchain) Tools() []*Tool {
+	tools := []*Tool{&tc.FFmpeg, &tc.FFprobe, &tc.CWebP, &tc.AVIFEnc, &tc.AVIFDec}
+	if tc.CJpeg.Path != "" {
+		tools = append(tools, &tc.CJpeg)
+	}
+	return append(tools, &tc.JPEGTran)
+}
+
+// Libraries that matter to us, out of the long list ffmpeg is usually built with
+var notableLibraries = []string{"libx264", "libx265", "libopus", "libwebp", "libaom", "libsvtav1"}
+
+func (t *Tool) NotableLibraries() []string {
+	var libs []string
+	for _, lib := range notableLibraries {
+		if t.HasLibrary(lib) {
+			libs = append(libs, strings.TrimPrefix(lib, "lib"))
+		}
+	}
+	return libs
+}
+
+// AudioUnavailable returns why audio can't be processed, or nil if they can
+func (tc *Toolchain) AudioUnavailable() error {
+	if tc.FFmpeg.Err != nil {
+		return tc.FFmpeg.Err
+	}
+	return tc.FFprobe.Err
+}
+
+// VideosUnavailable returns why videos can't be processed in the given video mode, or nil if they can
+func (tc *Toolchain) VideosUnavailable(videoMode string) error {
+	if err := tc.AudioUnavailable(); err != nil {
+		return err
+	}
+	if videoMode == RemuxMode {
+		return nil
+	}
+	return tc.VideoEncoderErr
+}
+
+// detectFFTool runs `name -version` and parses the output, which starts like this:
+//
+//    ffmpeg version 6.1.1-3ubuntu5 Copyright (c) 2000-2023 the FFmpeg developers
+//    built with gcc 13 (Ubuntu 13.2.0-23ubuntu3)
+//    configuration: --prefix=/usr --enable-gpl --enable-libx264 --enable-libopus ...
+//
+func detectFFTool(name string, configuredPath string) Tool {
+	tool := Tool{Name: name, Path: configuredPath}
+	if tool.Path == "" {
+		tool.Path = name
+	}
+
+	resolved, err := exec.LookPath(tool.Path)
+	if err != nil {
+		tool.Err = fmt.Errorf("%s not found: %w", name, err)
+		return tool
+	}
+	tool.Path = resolved
+
+	output, err := exec.Command(tool.Path, "-version").Output()
+	if err != nil {
+		tool.Err = fmt.Errorf("%s -version failed: %w", tool.Path, err)
+		return tool
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, name+" version ") {
+			fields := strings.Fields(line)
+			if len(fields) >= 3 {
+				tool.Version = fields[2]
+				fmt.Sscanf(strings.TrimPrefix(tool.Version, "n"), "%d.%d", &tool.Major, &tool.Minor)
+			}
+		}
+		if strings.HasPrefix(line, "configuration:") {
+			for _, option := range strings.Fields(line) {
+				if strings.HasPrefix(option, "--enable-lib") {
+					tool.Libraries = append(tool.Libraries, strings.TrimPrefix(option, "--enable-"))
+				}
+			}
+		}
+	}
+	if tool.Version == "" {
+		tool.Err = fmt.Errorf("%s does not look like %s", tool.Path, name)
+	}
+	return tool
+}
+
+// detectTool finds an optional tool and takes its version from what `name versionArg` prints,
+// which for the image encoders is like "1.2.4", "Version: 1.0.4 (...)" or "mozjpeg version 4.1.1 (...)"
+func detectTool(name string, configuredPath string, versionArg string) Tool {
+	tool := Tool{Name: name, Path: configuredPath, Optional: true}
+	if tool.Path == "" {
+		tool.Path = name
+	}
+
+	resolved, err := exec.LookPath(tool.Path)
+	if err != nil {
+		tool.Err = fmt.Errorf("%s not found: %w", name, err)
+		return tool
+	}
+	tool.Path = resolved
+
+	output, err := exec.Command(tool.Path, versionArg).CombinedOutput()
+	if err != nil {
+		tool.Err = fmt.Errorf("%s %s failed: %w", tool.Path, versionArg, err)
+		return tool
+	}
+	fields := strings.Fields(string(output))
+	for index, field := range fields {
+		if strings.EqualFold(strings.TrimSuffix(field, ":"), "version") && index+1 < len(fields) {
+			fields = fields[index+1:]
+			break
+		}
+	}
+	if len(fields) == 0 {
+		tool.Err = fmt.Errorf("%s did not print its version", tool.Path)
+		return tool
+	}
+	tool.Version = fields[0]
+	fmt.Sscanf(strings.TrimPrefix(tool.Version, "v"), "%d.%d", &tool.Major, &tool.Minor)
+	return tool
+}
@@ -2,6 +2,7 @@ package media_shrinker
 
 import "fmt"
 import "os"
+import "strings"
 import "time"
 
 import "github.com/gdamore/tcell/v2"
@@ -112,7 +113,7 @@ func (tui *Tui) Render() {
 
 	screenViewPort := AsViewPort(tui.Screen)
 	filesViewPort, bottomViewPort := screenViewPort.SplitV(-10)
-	messagesViewPort, _ := bottomViewPort.SplitH(-30)
+	messagesViewPort, toolsViewPort := bottomViewPort.SplitH(-30)
 	{
 		view := &tui.filesView
 		view.ScrollHeight = len(proc.MediaFiles) * 2
@@ -127,23 +128,44 @@ func (tui *Tui) Render() {
 			switch mediaFile.Stage {
 			case Waiting:
 				Print(viewport, x0, y, waitingStyle, mediaFile.Name)
+				if mediaFile.EstimatedSize > 0 {
+					percentage := float64(mediaFile.EstimatedSize)/float64(mediaFile.Size) * 100
+					x := x0 + maxFileNameLength + 5
+					Printf(viewport, x, y, waitingStyle, "[%s] -> ~[%s] (~%.2f%%) ~%s", BytesSize(mediaFile.Size), BytesSize(mediaFile.EstimatedSize), percentage, FormatTime(mediaFile.EstimatedTime.Seconds()))
+				}
 				y++
 			case ProcessingError:
 				Print(viewport, x0, y, errorStyle, mediaFile.Name)
+				if mediaFile.Error != nil {
+					x := x0 + maxFileNameLength + 5
+					Print(viewport, x, y, errorStyle, mediaFile.Error.Error())
+				}
 				y++
+				if mediaFile.LogPath != "" {
+					Printf(viewport, x0 + 2, y, waitingStyle, "log: %s", mediaFile.LogPath)
+				}
 			case ProcessingSuccess, AlreadyProcessed:
 				percentage := float64(mediaFile.ShrunkSize)/float64(mediaFile.Size) * 100
 
 				Print(viewport, x0, y, okStyle, mediaFile.Name)
 				x := x0 + maxFileNameLength + 5
 				x = Printf(viewport, x, y, tcell.StyleDefault, "[%s] -> [%s] (%.2f%%)", BytesSize(mediaFile.Size), BytesSize(mediaFile.ShrunkSize), percentage)
+				if mediaFile.QualityMetric != "" {
+					x = Print(viewport, x + 2, y, tcell.StyleDefault, mediaFile.QualityString())
+				}
+				if mediaFile.ImageSettings != "" {
+					x = Printf(viewport, x + 2, y, tcell.StyleDefault, "[%s]", mediaFile.ImageSettings)
+				}
+				if mediaFile.ColorProfile != "" {
+					x = Printf(viewport, x + 2, y, tcell.StyleDefault, "[%s]", mediaFile.ColorProfile)
+				}
 				if (mediaFile.Deleted) {
 					Print(viewport, x + 2, y, errorStyle, "DELETED")
 				}
 				y++
 			case ProcessingInProgress:
 				Print(viewport, x0, y, activeStyle, mediaFile.Name)
-				if mediaFile.Type == Video {
+				if mediaFile.Type == Video || mediaFile.Type == Audio {
 					// TODO show a progress bar
 					// fmt.Printf("%s -> %.2f%% [%.2f / %.2f]        \r", FormatTime(timePassed.Seconds()), percentage, durationProcessed, size.Duration)
 					x := x0 + maxFileNameLength + 5
@@ -155,6 +177,30 @@ func (tui *Tui) Render() {
 			}
 		}
 	}
+	if proc.Toolchain != nil {
+		y := 0
+		for _, tool := range proc.Toolchain.Tools() {
+			if tool.Available() {
+				Printf(toolsViewPort, 1, y, okStyle, "%s %s", tool.Name, tool.Version)
+			} else if tool.Optional {
+				Printf(toolsViewPort, 1, y, waitingStyle, "%s: not found", tool.Name)
+			} else {
+				Printf(toolsViewPort, 1, y, errorStyle, "%s: missing", tool.Name)
+			}
+			y++
+		}
+		if libs := proc.Toolchain.FFmpeg.NotableLibraries(); len(libs) > 0 {
+			Print(toolsViewPort, 1, y, waitingStyle, strings.Join(libs, " "))
+			y++
+		}
+		if err := proc.Toolchain.VideoEncoderErr; err != nil {
+			Print(toolsViewPort, 1, y, errorStyle, err.Error())
+			y++
+		}
+		if limits := proc.Resources.String(); limits != "" {
+			Print(toolsViewPort, 1, y, waitingStyle, limits)
+		}
+	}
 	{
 		view := &tui.messagesView
 		view.ScrollHeight = len(tui.Messages)
@@ -7,11 +7,87 @@ import "github.com/gdamore/tcell/v2"
 type Options struct {
 	SrcDir, DstDir, TmpDir string
 	DoClean, ReportOnly    bool
+
+	// Where to put a poster frame for every shrunk video and a thumbnail for every shrunk image.
+	// Empty to not make any.
+	ThumbsDir string
+
+	// Explicit paths of ffmpeg and ffprobe; found on PATH if empty
+	FFmpegPath, FFprobePath string
+
+	// Explicit paths of the optional image encoders; found on PATH if empty
+	CWebPPath, AVIFEncPath string
+
+	// Explicit path of avifdec, to verify avif images without ffmpeg; found on PATH if empty
+	AVIFDecPath string
+
+	// cjpeg compatible encoder (like mozjpeg's) for jpg images; the built-in encoder is used if empty
+	CJpegPath string
+
+	// Explicit path of jpegtran, for jpg images that need no resizing; found on PATH if empty
+	JPEGTranPath string
+
+	// Threads, priorities and limits for the ffmpeg processes
+	Resources ResourceLimits
+
+	// Where the output of ffmpeg is logged for every file that failed. Defaults to a directory in TmpDir.
+	LogsDir string
+
+	// Only estimate the output size and processing time by encoding samples
+	Estimate bool
+
+	// Videos at least ChunkMinDuration long are split into segments of about ChunkDuration
+	// and encoded by ChunkJobs ffmpeg processes at the same time.
+	ChunkJobs                       int
+	ChunkMinDuration, ChunkDuration time.Duration
+
+	// Keep encoded chunks in TmpDir so an interrupted video can be resumed by the next run
+	Resume bool
+
+	// "encode" to re-encode videos, "remux" to only copy their streams into a clean mp4,
+	// or "hls" to make an HLS package directory of several renditions
+	VideoMode string
+
+	// Audio files are encoded with AudioCodec ("opus" or "aac") at AudioBitrate kbps,
+	// and downmixed to a single channel if AudioMono
+	AudioCodec   string
+	AudioBitrate int
+	AudioMono    bool
+
+	// Encoder settings for camera footage, and for screen recordings and low motion videos.
+	// Which one is used is detected per video unless DetectScreen is off, and MotionAnalysis
+	// adds a slower check that decodes the start of the video.
+	CameraProfile, ScreenProfile VideoProfile
+	DetectScreen, MotionAnalysis bool
+
+	// Sizing and encoding of photos (jpg) and graphics (png)
+	PhotoPolicy, GraphicPolicy ImagePolicy
+
+	// What to do with the colour profiles of images: "keep" to embed them in the shrunk image,
+	// or "srgb" to convert the pixels to sRGB
+	ColorProfile string
+
+	// Compare shrunk videos against the original ("ssim", "psnr" or empty to skip), and
+	// re-encode at a better quality (up to QualityRetries times) if the score is below QualityFloor
+	QualityMetric                  string
+	QualityFloor                   float64
+	QualitySamples, QualityRetries int
+}
+
+type VideoProfile struct {
+	Name         string
+	CRF          int
+	Preset, Tune string  // x264 -preset and -tune, default if empty
+	MaxFrameRate float64 // frame rate cap, 0 for none
+
+	// ffmpeg filters applied before scaling, see FilterChain
+	Filters []string
 }
 
 type ProcessorData struct {
 	Options
 	MediaFiles []MediaFile
+	Toolchain  *Toolchain
 }
 
 // I would have liked to name this 'Size' but ..
@@ -61,6 +137,7 @@ const (
 	Video
 	JPG
 	PNG
+	Audio
 )
 
 type ProcessingStage int
@@ -85,9 +162,13 @@ type MediaFile struct {
 	Dir, Name string
 	Size      int // in bytes
 
+	// Name in the destination directory; can have a different extension than Name
+	OutputName string
+
 	Stage      ProcessingStage
 	ShrunkSize int
 	Error      error // if processing failed, or if processing worked but some other error occurred
+	LogPath    string // the log of the commands run, kept if processing failed
 
 	// When in progress, how far along are we!
 	Percentage float64
@@ -95,6 +176,28 @@ type MediaFile struct {
 	// For videos, duration processed (in seconds)
 	Processed float64
 
+	// For videos, the name of the encoder profile used
+	Profile string
+
+	// For videos processed in remux mode; streams other than video and audio are dropped
+	Remuxed        bool
+	DroppedStreams int
+
+	// For images, how they were sized and encoded, see ImagePolicy; kept for later runs, see saveImageSettings
+	ImageSettings string
+
+	// For images, the name of the embedded colour profile, and whether it was converted to sRGB
+	ColorProfile string
+
+	// Projected by the estimate mode
+	EstimatedSize int
+	EstimatedTime time.Duration
+
+	// For videos, the result of the quality check, if enabled;
+	// for images, the score of the chosen jpg quality or png palette
+	QualityMetric string
+	QualityScore  float64
+
 	Deleted bool
 
 	StartTime, EndTime time.Time
@@ -106,6 +209,11 @@ type ProcessingRequest struct {
 	InputPath  string
 	OutputPath string
 
+	Options *Options
+
+	// Where the output of external commands goes; can be nil
+	Log *FileLog
+
 	UI UI
 }
 
@@ -114,6 +222,11 @@ type ShrunkStats struct {
 	SizeBefore int
 	SizeAfter int
 
+	RemuxedCount int
+	RemuxedSizeBefore int
+	RemuxedSizeAfter int
+	DroppedStreams int
+
 	DeletedCount int
 	DeletedSize int
 	DeletedShrunkSize int
@@ -2,10 +2,12 @@ package media_shrinker
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"math"
 	"os/exec"
+	"path"
 	"strings"
 	// "time"
 )
@@ -52,7 +54,7 @@ func ProbeVideoSize(inpath string) (out VideoSize, err error) {
 		"-of", "default=noprint_wrappers=1:nokey=1",
 		inpath,
 	}
-	probeCmd := exec.Command("ffprobe", probeArgs...)
+	probeCmd := ffprobeCommand(probeArgs...)
 	output, err := probeCmd.CombinedOutput()
 	if err != nil {
 		return out, fmt.Errorf("Could not get video dimensions. ffprobe command failed with: %w", err)
@@ -65,31 +67,214 @@ func ProbeVideoSize(inpath string) (out VideoSize, err error) {
 	return out, nil
 }
 
+// The crf used for videos unless the profile or the quality check asks for something else
+const defaultCRF = 26
+
+// videoSourceFilters is the filter chain applied to the source before scaling: the frame rate cap
+// and the resolved filters of the profile, like crop
+func videoSourceFilters(info *VideoInfo, profile *VideoProfile, filters []string) []string {
+	var chain []string
+	if profile.MaxFrameRate > 0 && info.FrameRate > profile.MaxFrameRate {
+		chain = append(chain, fmt.Sprintf("fps=%g", profile.MaxFrameRate))
+	}
+	return append(chain, filters...)
+}
+
+// videoEncodeArgs returns the ffmpeg output arguments used to re-encode the video stream.
+// filters are the profile's filters, already resolved for this video.
+func videoEncodeArgs(info *VideoInfo, profile *VideoProfile, filters []string, crf int) []string {
+	// FIXME: maybe if size is already smaller than desired, don't scale up!!
+
+	width, height := info.DisplaySize()
+	var desired_width = 1080
+	if width < height { // vertical video
+		desired_width = 720
+	}
+
+	chain := videoSourceFilters(info, profile, filters)
+	capFrameRate := profile.MaxFrameRate > 0 && info.FrameRate > profile.MaxFrameRate
+	// after cropping we don't know the width anymore, so let ffmpeg compare it
+	if width > desired_width || len(filters) > 0 {
+		chain = append(chain, fmt.Sprintf(`scale='min(%d,iw)':-2`, desired_width))
+	}
+
+	var args []string
+	if len(chain) > 0 {
+		args = append(args, "-vf", strings.Join(chain, ","))
+	}
+	args = append(args, "-c:v", "libx264", "-crf", fmt.Sprint(crf))
+	if profile.Preset != "" {
+		args = append(args, "-preset", profile.Preset)
+	}
+	if profile.Tune != "" {
+		args = append(args, "-tune", profile.Tune)
+	}
+
+	// By default ffmpeg makes the output constant frame rate by duplicating and dropping frames,
+	// which for variable frame rate videos can drift the audio out of sync.
+	// The fps filter already makes it constant, in a controlled way.
+	if info.VariableFrameRate && !capFrameRate {
+		args = append(args, passthroughTimestampsArgs()...)
+	}
+	return args
+}
+
+// passthroughTimestampsArgs keeps the timestamps of the frames as they are; the option was renamed in ffmpeg 5.1
+func passthroughTimestampsArgs() []string {
+	if toolchain.FFmpeg.AtLeast(5, 1) {
+		return []string{"-fps_mode", "passthrough"}
+	}
+	return []string{"-vsync", "passthrough"}
+}
+
 // returns nil if success
 func ShrinkMovie(request ProcessingRequest, ui UI) (result error) {
-	size, err := ProbeVideoSize(request.InputPath)
+	info, err := ProbeVideoInfo(request.InputPath)
 	if err != nil {
 		return fmt.Errorf("Probing video size failed: %w", err)
 	}
+	size := info.VideoSize
 
-	// FIXME: maybe if size is already smaller than desired, don't scale up!!
+	switch request.Options.VideoMode {
+	case RemuxMode:
+		return RemuxMovie(request, &info, ui)
+	case HLSMode:
+		return ShrinkMovieHLS(request, &info, ui)
+	}
 
-	var desired_width = 1080
-	if size.Width < size.Height { // vertical video
-		desired_width = 720
+	if info.VariableFrameRate {
+		ui.Logf("%s has a variable frame rate; keeping its timestamps", request.Target.Name)
+	}
+
+	opts := request.Options
+	profile := chooseVideoProfile(opts, request.InputPath, &info, request.Log, ui)
+	request.Target.Profile = profile.Name
+	filters := resolveFilters(profile.Filters, request.InputPath, &info, request.Log, ui)
+
+	crf := profile.CRF
+	for attempt := 0; ; attempt++ {
+		err = encodeMovie(request, &info, videoEncodeArgs(&info, profile, filters, crf), ui)
+		if err != nil {
+			return err
+		}
+
+		if opts.QualityMetric == "" {
+			break
+		}
+
+		floor := opts.QualityFloorFor()
+		score, err := MeasureVideoQuality(request.InputPath, request.OutputPath, videoSourceFilters(&info, profile, filters), opts.QualityMetric, size.Duration, opts.QualitySamples, request.Log, ui)
+		if err != nil {
+			// the check is extra assurance; the output already passed the duration check
+			ui.Logf("Quality check of %s failed: %v", request.Target.Name, err)
+			break
+		}
+		request.Target.QualityMetric = opts.QualityMetric
+		request.Target.QualityScore = score
+
+		if score >= floor {
+			break
+		}
+		if attempt >= opts.QualityRetries || crf-qualityCRFStep < minCRF {
+			ui.Logf("warning: %s scored %s %.4f, below %.4f, even at crf %d", request.Target.Name, opts.QualityMetric, score, floor, crf)
+			break
+		}
+		crf -= qualityCRFStep
+		ui.Logf("%s scored %s %.4f, below %.4f; re-encoding at crf %d", request.Target.Name, opts.QualityMetric, score, floor, crf)
+	}
+
+	// success!!
+	return nil
+}
+
+// encodeMovie re-encodes the video and checks the result has the same duration, and audio still in sync
+func encodeMovie(request ProcessingRequest, info *VideoInfo, encodeArgs []string, ui UI) error {
+	size := info.VideoSize
+	var err error
+	if useChunks(request.Options, size) {
+		err = shrinkMovieChunked(request, size, encodeArgs, ui)
+	} else {
+		// ffmpeg -i SRC/NAME -vf scale="DESIRED_WIDTH:-1" DST/NAME
+		var args = []string{
+			"-y", "-i", request.InputPath,
+		}
+		args = append(args, encodeArgs...)
+		args = append(args, request.OutputPath)
+		err = runFFmpeg(args, request.Log, ui, func(durationProcessed float64) {
+			request.Target.Percentage = (durationProcessed / size.Duration) * 100
+			request.Target.Processed = durationProcessed
+			ui.Update()
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	// check the duration of the written file matches our duration
+	{
+		outSize, err := ProbeVideoSize(request.OutputPath)
+		if err != nil {
+			// os.Remove(request.OutputPath)
+			return fmt.Errorf("Conversion appears to be failed because ffprobe failed: %w", err)
+		}
+
+		if !DurationsRoughlyEqual(size.Duration, outSize.Duration) {
+			return fmt.Errorf("Conversion failed; duration mismatch: %8.2f -> %8.2f", size.Duration, outSize.Duration)
+		}
 	}
 
-	// ffmpeg -i SRC/NAME -vf scale="DESIRED_WIDTH:-1" DST/NAME
-	var args = []string{
-		"-y", "-i", request.InputPath,
+	{
+		outInfo, err := ProbeVideoInfo(request.OutputPath)
+		if err != nil {
+			return fmt.Errorf("Conversion appears to be failed because ffprobe failed: %w", err)
+		}
+		if err := CheckAVSync(info, &outInfo); err != nil {
+			return fmt.Errorf("Conversion failed; %w", err)
+		}
+	}
+	return nil
+}
+
+// How far the timing of the output streams may be from the input before we call it out of sync, in seconds
+const (
+	streamStartTolerance    = 0.1
+	audioVideoDiffTolerance = 0.25
+)
+
+// CheckAVSync compares when each stream starts, and how much longer or shorter the audio
+// is than the video, between the input and the output
+func CheckAVSync(in, out *VideoInfo) error {
+	if math.Abs(in.VideoStart-out.VideoStart) > streamStartTolerance {
+		return fmt.Errorf("video start time mismatch: %.3f -> %.3f", in.VideoStart, out.VideoStart)
+	}
+	if !in.HasAudio {
+		return nil
+	}
+	if !out.HasAudio {
+		return fmt.Errorf("audio stream missing from the output")
 	}
-	if size.Width > desired_width {
-		args = append(args, "-vf", fmt.Sprintf(`scale=%d:-1`, desired_width))
+	inOffset := in.AudioStart - in.VideoStart
+	outOffset := out.AudioStart - out.VideoStart
+	if math.Abs(inOffset-outOffset) > streamStartTolerance {
+		return fmt.Errorf("audio offset from video mismatch: %.3f -> %.3f", inOffset, outOffset)
 	}
-	args = append(args, "-c:v", "libx264", "-crf", "26")
-	args = append(args, request.OutputPath)
-	cmd := exec.Command("ffmpeg", args...)
-	registerCommand(cmd)
+	if in.AudioDuration > 0 && out.AudioDuration > 0 {
+		inDiff := in.AudioDuration - in.Duration
+		outDiff := out.AudioDuration - out.Duration
+		if math.Abs(inDiff-outDiff) > audioVideoDiffTolerance {
+			return fmt.Errorf("audio/video duration difference mismatch: %.3f -> %.3f", inDiff, outDiff)
+		}
+	}
+	return nil
+}
+
+// runFFmpeg runs ffmpeg with the given arguments and waits for it to finish.
+// The text output of ffmpeg goes to the log (which can be nil), and is parsed to report
+// the duration processed (in seconds) to onProgress, which can also be nil.
+func runFFmpeg(args []string, log *FileLog, ui UI, onProgress func(durationProcessed float64)) error {
+	cmd := ffmpegCommand(args...)
+	child := registerCommand(cmd)
+	log.Command(cmd)
 
 	cmdout, err := cmd.StderrPipe()
 	if err != nil {
@@ -98,12 +283,21 @@ func ShrinkMovie(request ProcessingRequest, ui UI) (result error) {
 
 	// startTime := time.Now()
 	ui.Log(cmd.String())
-	cmd.Start()
+	if err := child.Start(); err != nil {
+		if cmd.Process != nil { // it started but the limits could not be applied
+			cmd.Process.Kill()
+			cmd.Wait()
+		}
+		return fmt.Errorf("could not start ffmpeg: %w", err)
+	}
 
 	// Read the text output of ffmpeg and parse it to understand progress and present it to the user
+	var tail outputTail
 	reader := bufio.NewReader(cmdout)
 	for {
 		line, err := reader.ReadString('\r')
+		log.Output(line)
+		tail.Add(line)
 
 		if err != nil {
 			if err != io.EOF {
@@ -111,13 +305,17 @@ func ShrinkMovie(request ProcessingRequest, ui UI) (result error) {
 				// This is an IO error. It doesn't necessarily mean processing failed.
 				// Just break out of the I/O parsing loop and
 				// wait for the FFMPEG process to finish
-				ui.Logf("I/O error while interacting with ffmpeg %w", err)
+				ui.Logf("I/O error while interacting with ffmpeg %v", err)
 
 				// FIXME end the process now and return the error!!
 			}
 			break
 		}
 
+		if onProgress == nil {
+			continue
+		}
+
 		timestampIndex := strings.LastIndex(line, "time=")
 		if timestampIndex == -1 {
 			ui.Log("warning: no timestamp found!!")
@@ -132,11 +330,8 @@ func ShrinkMovie(request ProcessingRequest, ui UI) (result error) {
 		}
 		ts = ts[:spaceIndex]
 		durationProcessed := ParseTime_FF(ts) // of the video
-		percentage := (float64(durationProcessed) / size.Duration) * 100
 		// timePassed := time.Since(startTime) // monotonic clock time
-		request.Target.Percentage = percentage
-		request.Target.Processed = durationProcessed
-		ui.Update()
+		onProgress(durationProcessed)
 
 		// FIXME use a "print status line" function instead?
 		// fmt.Printf("%s -> %.2f%% [%.2f / %.2f]        \r", FormatTime(timePassed.Seconds()), percentage, durationProcessed, size.Duration)
@@ -146,35 +341,79 @@ func ShrinkMovie(request ProcessingRequest, ui UI) (result error) {
 	{
 		err := cmd.Wait()
 		if err != nil {
-			return fmt.Errorf("ffmpeg did not close properly? %w", err)
+			return newFFmpegError(err, &tail, log)
 		}
 	}
 
-	// check the duration of the written file matches our duration
-	{
-		outSize, err := ProbeVideoSize(request.OutputPath)
-		if err != nil {
-			// os.Remove(request.OutputPath)
-			return fmt.Errorf("Conversion appears to be failed because ffprobe failed: %w", err)
-		}
-
-		if !DurationsRoughlyEqual(size.Duration, outSize.Duration) {
-			return fmt.Errorf("Conversion failed; duration mismatch: %8.2f -> %8.2f", size.Duration, outSize.Duration)
-		}
-	}
-
-	// success!!
 	return nil
 }
 
-var runningCommands []*exec.Cmd
-func registerCommand(cmd *exec.Cmd) {
-	runningCommands = append(runningCommands, cmd)
+// ffmpegOutput runs ffmpeg to completion and returns everything it printed
+func ffmpegOutput(args []string, log *FileLog, ui UI) (string, error) {
+	return commandOutput(ffmpegCommand(args...), log, ui)
 }
 
-func killChildCommands() {
-	for _, cmd := range runningCommands {
-		// can fail silently if already killed - we don't care
+// commandOutput runs an external command to completion (with the resource limits) and returns everything it printed
+func commandOutput(cmd *exec.Cmd, log *FileLog, ui UI) (string, error) {
+	child := registerCommand(cmd)
+	log.Command(cmd)
+	ui.Log(cmd.String())
+
+	var buffer bytes.Buffer
+	cmd.Stdout = &buffer
+	cmd.Stderr = &buffer
+	err := child.Start()
+	if err == nil {
+		err = cmd.Wait()
+	} else if cmd.Process != nil {
 		cmd.Process.Kill()
+		cmd.Wait()
+	}
+	output := buffer.Bytes()
+	log.Output(string(output))
+	if err != nil {
+		var tail outputTail
+		tail.Add(string(output))
+		ffErr := newFFmpegError(err, &tail, log)
+		ffErr.Tool = path.Base(cmd.Path)
+		return string(output), ffErr
+	}
+	return string(output), nil
+}
+
+// pipeCommand runs an external command to completion (with the resource limits), feeding it stdin and
+// collecting its stdout; what it prints to stderr goes to the log, and the error if it fails
+func pipeCommand(cmd *exec.Cmd, stdin io.Reader, stdout io.Writer, log *FileLog, ui UI) error {
+	child := registerCommand(cmd)
+	log.Command(cmd)
+	ui.Log(cmd.String())
+
+	var stderr bytes.Buffer
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	err := child.Start()
+	if err == nil {
+		err = cmd.Wait()
+	} else if cmd.Process != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+	log.Output(stderr.String())
+	if err != nil {
+		var tail outputTail
+		tail.Add(stderr.String())
+		ffErr := newFFmpegError(err, &tail, log)
+		ffErr.Tool = path.Base(cmd.Path)
+		return ffErr
+	}
+	return nil
+}
+
+func newFFmpegError(err error, tail *outputTail, log *FileLog) *FFmpegError {
+	ffErr := &FFmpegError{Tool: "ffmpeg", Err: err, Tail: tail.lines}
+	if log != nil {
+		ffErr.LogPath = log.Path
 	}
+	return ffErr
 }
@@ -0,0 +1,195 @@
+package media_shrinker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"os"
+)
+
+// WebP output for images. There's no WebP encoder in Go, so the resized image is handed over to cwebp
+// as a png, or to ffmpeg if it's built with libwebp.
+//
+// Neither of them gets the metadata, so it's added afterwards: the encoded image is wrapped in the
+// extended WebP format (a VP8X chunk first) with the ICC profile, EXIF and XMP in their own chunks.
+
+const WebPFormat = "webp"
+
+// webpEncoderAvailable tells whether any of the tools that can encode webp is there
+func webpEncoderAvailable() bool {
+	return toolchain.CWebP.Available() || (toolchain.FFmpeg.Available() && toolchain.FFmpeg.HasLibrary("libwebp"))
+}
+
+// hasAlpha tells whether any pixel of the image is not fully opaque
+func hasAlpha(img image.Image) bool {
+	if opaque, ok := img.(interface{ Opaque() bool }); ok {
+		return !opaque.Opaque()
+	}
+	return true
+}
+
+// encodeWebP writes the image to request.OutputPath as webp, with the given metadata and colour profile
+func encodeWebP(request ProcessingRequest, img image.Image, policy *ImagePolicy, metadata []jpegSegment, colorProfile []byte, ui UI) (imageEncoding, error) {
+	var encoding imageEncoding
+	sourcePath, err := writeEncoderSource(request, img)
+	if err != nil {
+		return encoding, err
+	}
+	defer os.Remove(sourcePath)
+
+	alpha := hasAlpha(img)
+	if toolchain.CWebP.Available() {
+		encoding.Encoder = "cwebp"
+		args := []string{"-quiet", "-metadata", "none", "-m", "6"}
+		if policy.Lossless {
+			args = append(args, "-lossless", "-exact")
+		} else {
+			args = append(args, "-q", fmt.Sprint(policy.Quality))
+		}
+		args = append(args, sourcePath, "-o", request.OutputPath)
+		_, err = commandOutput(cwebpCommand(args...), request.Log, ui)
+	} else {
+		encoding.Encoder = "ffmpeg libwebp"
+		args := []string{"-y", "-i", sourcePath, "-c:v", "libwebp", "-compression_level", "6"}
+		if policy.Lossless {
+			args = append(args, "-lossless", "1")
+		} else {
+			args = append(args, "-quality", fmt.Sprint(policy.Quality))
+			if alpha {
+				args = append(args, "-pix_fmt", "yuva420p")
+			}
+		}
+		args = append(args, "-frames:v", "1", "-f", "webp", request.OutputPath)
+		_, err = ffmpegOutput(args, request.Log, ui)
+	}
+	if err != nil {
+		return encoding, fmt.Errorf("Could not encode webp: %w", err)
+	}
+
+	var exif, xmp []byte
+	for _, segment := range metadata {
+		switch {
+		case bytes.HasPrefix(segment.Data, exifHeader):
+			exif = segment.Data[len(exifHeader):]
+		case bytes.HasPrefix(segment.Data, xmpHeader):
+			xmp = segment.Data[len(xmpHeader):]
+		}
+		// extended XMP only has a meaning in JPEG files
+	}
+	if exif == nil && xmp == nil && colorProfile == nil {
+		return encoding, nil
+	}
+
+	encoded, err := ioutil.ReadFile(request.OutputPath)
+	if err != nil {
+		return encoding, err
+	}
+	size := img.Bounds().Size()
+	extended, err := extendWebP(encoded, size.X, size.Y, alpha, colorProfile, exif, xmp)
+	if err != nil {
+		return encoding, fmt.Errorf("Could not add metadata to webp: %w", err)
+	}
+	return encoding, ioutil.WriteFile(request.OutputPath, extended, 0o644)
+}
+
+type riffChunk struct {
+	FourCC string
+	Data   []byte
+}
+
+// readWebPChunks splits a webp file into its chunks
+func readWebPChunks(webp []byte) ([]riffChunk, error) {
+	if len(webp) < 12 || string(webp[:4]) != "RIFF" || string(webp[8:12]) != "WEBP" {
+		return nil, fmt.Errorf("not a webp file")
+	}
+	var chunks []riffChunk
+	offset := 12
+	for offset+8 <= len(webp) {
+		fourCC := string(webp[offset : offset+4])
+		size := int(binary.LittleEndian.Uint32(webp[offset+4:]))
+		start := offset + 8
+		if size < 0 || start+size > len(webp) {
+			return nil, fmt.Errorf("webp chunk %q truncated", fourCC)
+		}
+		chunks = append(chunks, riffChunk{FourCC: fourCC, Data: webp[start : start+size]})
+		offset = start + size + size%2 // chunks are padded to an even size
+	}
+	return chunks, nil
+}
+
+// VP8X flags
+const (
+	webpFlagICC   = 0x20
+	webpFlagAlpha = 0x10
+	webpFlagEXIF  = 0x08
+	webpFlagXMP   = 0x04
+)
+
+// extendWebP rewrites the webp in the extended format, with the ICCP chunk before the image
+// and the EXIF and XMP chunks after it, as the format requires
+func extendWebP(webp []byte, width, height int, alpha bool, icc, exif, xmp []byte) ([]byte, error) {
+	chunks, err := readWebPChunks(webp)
+	if err != nil {
+		return nil, err
+	}
+
+	var frame []riffChunk // ALPH and VP8, or VP8L
+	for _, chunk := range chunks {
+		switch chunk.FourCC {
+		case "ALPH", "VP8 ", "VP8L":
+			frame = append(frame, chunk)
+		case "ANIM", "ANMF":
+			return nil, fmt.Errorf("animated webp")
+		}
+	}
+	if len(frame) == 0 {
+		return nil, fmt.Errorf("no image in webp")
+	}
+
+	vp8x := make([]byte, 10)
+	if alpha {
+		vp8x[0] |= webpFlagAlpha
+	}
+	out := []riffChunk{{FourCC: "VP8X", Data: vp8x}}
+	if icc != nil {
+		vp8x[0] |= webpFlagICC
+		out = append(out, riffChunk{FourCC: "ICCP", Data: icc})
+	}
+	out = append(out, frame...)
+	if exif != nil {
+		vp8x[0] |= webpFlagEXIF
+		out = append(out, riffChunk{FourCC: "EXIF", Data: exif})
+	}
+	if xmp != nil {
+		vp8x[0] |= webpFlagXMP
+		out = append(out, riffChunk{FourCC: "XMP ", Data: xmp})
+	}
+	// the canvas size, minus one, in 24 bits each
+	putUint24(vp8x[4:], width-1)
+	putUint24(vp8x[7:], height-1)
+
+	var body bytes.Buffer
+	body.WriteString("WEBP")
+	for _, chunk := range out {
+		body.WriteString(chunk.FourCC)
+		binary.Write(&body, binary.LittleEndian, uint32(len(chunk.Data)))
+		body.Write(chunk.Data)
+		if len(chunk.Data)%2 == 1 {
+			body.WriteByte(0)
+		}
+	}
+
+	var file bytes.Buffer
+	file.WriteString("RIFF")
+	binary.Write(&file, binary.LittleEndian, uint32(body.Len()))
+	file.Write(body.Bytes())
+	return file.Bytes(), nil
+}
+
+func putUint24(b []byte, v int) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+}
@@ -0,0 +1,170 @@
+package media_shrinker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// testWebP writes the chunks as a webp file, padded as the format requires
+func testWebP(chunks ...riffChunk) []byte {
+	var body bytes.Buffer
+	body.WriteString("WEBP")
+	for _, chunk := range chunks {
+		body.WriteString(chunk.FourCC)
+		binary.Write(&body, binary.LittleEndian, uint32(len(chunk.Data)))
+		body.Write(chunk.Data)
+		if len(chunk.Data)%2 == 1 {
+			body.WriteByte(0)
+		}
+	}
+	file := []byte("RIFF\x00\x00\x00\x00")
+	binary.LittleEndian.PutUint32(file[4:], uint32(body.Len()))
+	return append(file, body.Bytes()...)
+}
+
+func testFourCCs(chunks []riffChunk) []string {
+	var fourCCs []string
+	for _, chunk := range chunks {
+		fourCCs = append(fourCCs, chunk.FourCC)
+	}
+	return fourCCs
+}
+
+func TestReadWebPChunks(t *testing.T) {
+	want := []riffChunk{
+		{FourCC: "ALPH", Data: []byte("odd")},
+		{FourCC: "VP8 ", Data: []byte("even")},
+	}
+	chunks, err := readWebPChunks(testWebP(want...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != len(want) {
+		t.Fatalf("got chunks %q, want %q", testFourCCs(chunks), testFourCCs(want))
+	}
+	for index := range want {
+		if chunks[index].FourCC != want[index].FourCC || !bytes.Equal(chunks[index].Data, want[index].Data) {
+			t.Errorf("chunk %d is %q %q, want %q %q", index, chunks[index].FourCC, chunks[index].Data, want[index].FourCC, want[index].Data)
+		}
+	}
+}
+
+func TestReadWebPChunksInvalid(t *testing.T) {
+	tooLong := testWebP(riffChunk{FourCC: "VP8L", Data: []byte("data")})
+	binary.LittleEndian.PutUint32(tooLong[16:], 0xFFFFFFFF)
+
+	tests := []struct {
+		name string
+		webp []byte
+	}{
+		{"empty", nil},
+		{"short", []byte("RIFF\x00\x00")},
+		{"not riff", []byte("RIFX\x04\x00\x00\x00WEBP")},
+		{"not webp", []byte("RIFF\x04\x00\x00\x00WAVE")},
+		{"chunk past the end", tooLong},
+	}
+	for _, test := range tests {
+		if _, err := readWebPChunks(test.webp); err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+
+	// a truncated chunk is an error, however short the file is cut
+	webp := testWebP(riffChunk{FourCC: "VP8L", Data: []byte("image data")})
+	for length := 21; length < len(webp); length++ {
+		if _, err := readWebPChunks(webp[:length]); err == nil {
+			t.Errorf("no error with only %d of %d bytes", length, len(webp))
+		}
+	}
+}
+
+func TestExtendWebP(t *testing.T) {
+	tests := []struct {
+		name           string
+		frame          []riffChunk
+		alpha          bool
+		icc, exif, xmp []byte
+		flags          byte
+		want           []string
+	}{
+		{
+			name:  "lossless",
+			frame: []riffChunk{{FourCC: "VP8L", Data: []byte("lossless")}},
+			want:  []string{"VP8X", "VP8L"},
+		},
+		{
+			name:  "everything",
+			frame: []riffChunk{{FourCC: "ALPH", Data: []byte("alpha")}, {FourCC: "VP8 ", Data: []byte("lossy")}},
+			alpha: true,
+			icc:   []byte("profile"),
+			exif:  []byte("Exif"),
+			xmp:   []byte("<x:xmpmeta/>"),
+			flags: webpFlagAlpha | webpFlagICC | webpFlagEXIF | webpFlagXMP,
+			want:  []string{"VP8X", "ICCP", "ALPH", "VP8 ", "EXIF", "XMP "},
+		},
+		{
+			name:  "only xmp",
+			frame: []riffChunk{{FourCC: "VP8 ", Data: []byte("lossy")}},
+			xmp:   []byte("<x:xmpmeta/>"),
+			flags: webpFlagXMP,
+			want:  []string{"VP8X", "VP8 ", "XMP "},
+		},
+	}
+	for _, test := range tests {
+		extended, err := extendWebP(testWebP(test.frame...), 1920, 1080, test.alpha, test.icc, test.exif, test.xmp)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if size := int(binary.LittleEndian.Uint32(extended[4:])); size != len(extended)-8 {
+			t.Errorf("%s: RIFF size %d, want %d", test.name, size, len(extended)-8)
+		}
+		chunks, err := readWebPChunks(extended)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if got := testFourCCs(chunks); len(got) != len(test.want) {
+			t.Fatalf("%s: chunks %q, want %q", test.name, got, test.want)
+		}
+		for index, fourCC := range test.want {
+			if chunks[index].FourCC != fourCC {
+				t.Errorf("%s: chunks %q, want %q", test.name, testFourCCs(chunks), test.want)
+				break
+			}
+		}
+
+		vp8x := chunks[0].Data
+		if len(vp8x) != 10 {
+			t.Fatalf("%s: VP8X is %d bytes, want 10", test.name, len(vp8x))
+		}
+		if vp8x[0] != test.flags {
+			t.Errorf("%s: flags %#02x, want %#02x", test.name, vp8x[0], test.flags)
+		}
+		width := int(vp8x[4]) | int(vp8x[5])<<8 | int(vp8x[6])<<16
+		height := int(vp8x[7]) | int(vp8x[8])<<8 | int(vp8x[9])<<16
+		if width+1 != 1920 || height+1 != 1080 {
+			t.Errorf("%s: canvas %dx%d, want 1920x1080", test.name, width+1, height+1)
+		}
+		for _, chunk := range chunks {
+			if chunk.FourCC == "XMP " && !bytes.Equal(chunk.Data, test.xmp) {
+				t.Errorf("%s: XMP is %q, want %q", test.name, chunk.Data, test.xmp)
+			}
+		}
+	}
+}
+
+func TestExtendWebPInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		webp []byte
+	}{
+		{"not webp", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x00")},
+		{"no image", testWebP(riffChunk{FourCC: "EXIF", Data: []byte("Exif")})},
+		{"animated", testWebP(riffChunk{FourCC: "ANIM", Data: make([]byte, 6)}, riffChunk{FourCC: "ANMF", Data: make([]byte, 16)})},
+	}
+	for _, test := range tests {
+		if _, err := extendWebP(test.webp, 16, 16, false, nil, nil, []byte("xmp")); err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+}